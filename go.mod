@@ -3,10 +3,12 @@ module github.com/draxil/springboard
 go 1.17
 
 require (
+	github.com/BurntSushi/toml v1.3.2
 	github.com/draxil/gomv v0.0.0-20160224112501-18db38460281
 	github.com/theckman/go-flock v0.8.1
 	github.com/urfave/cli v1.22.5
 	gopkg.in/fsnotify.v1 v1.4.7
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -1,10 +1,15 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"github.com/draxil/springboard/watch"
 	"github.com/urfave/cli"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 )
 
 const version = "0.3.2"
@@ -20,8 +25,9 @@ func app() *cli.App {
 	app := cli.NewApp()
 	app.Name = "springboard"
 	app.Usage = "Watch a directory for files and send them places"
-	commands, flags, _ := setup()
+	commands, flags, cfg := setup()
 	app.Commands = commands
+	app.Action = wrapCmd(cfg, config_command(cfg)).Action
 	app.Version = version
 	app.Authors = []cli.Author{
 		{
@@ -45,6 +51,8 @@ func setup() (c []cli.Command, f []cli.Flag, cfg *watch.Config) {
 	addCommand(http_post_command(cfg, run_watch))
 	addCommand(echo_command(cfg, run_watch))
 	addCommand(run_command(cfg, run_watch))
+	c = append(c, redrive_command(cfg))
+	c = append(c, validate_config_command(cfg))
 
 	return
 }
@@ -59,24 +67,112 @@ func wrapCmd(cfg *watch.Config, c cli.Command) cli.Command {
 }
 
 func setupAction(cfg *watch.Config, c *cli.Context) {
+	cfg.Retry.MaxAttempts = c.GlobalInt("retries") + 1
+
 	sparanoia := c.GlobalString("paranoia")
-	switch sparanoia {
-	case "off":
-		cfg.Paranoia = watch.NoParanoia
-	case "basic":
-		cfg.Paranoia = watch.BasicParanoia
-	case "extra":
-		cfg.Paranoia = watch.ExtraParanoia
-	default:
-		fmt.Fprintln(os.Stderr, "Invalid choice of paranoia=", c)
+	paranoia, err := watch.ParseParanoia(sparanoia)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid choice of paranoia=", sparanoia)
 		cli.ShowSubcommandHelp(c)
 		os.Exit(1)
 	}
+	cfg.Paranoia = paranoia
+
+	if path := c.GlobalString("config"); path != "" {
+		if err := loadConfigFile(cfg, c, path); err != nil {
+			fmt.Fprintln(os.Stderr, "Could not load config:", err)
+			os.Exit(1)
+		}
+	}
+}
+
+/*
+  Where each global flag lives in the config, so flags given on the command
+  line can take precedence over the config file.
+*/
+var flagFields = []struct {
+	flag string
+	copy func(dst, src *watch.Config)
+}{
+	{"archive", func(d, s *watch.Config) { d.ArchiveDir = s.ArchiveDir }},
+	{"error-dir", func(d, s *watch.Config) { d.ErrorDir = s.ErrorDir }},
+	{"paranoia", func(d, s *watch.Config) { d.Paranoia = s.Paranoia }},
+	{"marker-suffix", func(d, s *watch.Config) { d.MarkerSuffixes = s.MarkerSuffixes }},
+	{"archive-markers", func(d, s *watch.Config) { d.ArchiveMarkers = s.ArchiveMarkers }},
+	{"quiet-period", func(d, s *watch.Config) { d.QuietPeriod = s.QuietPeriod }},
+	{"paranoia-window", func(d, s *watch.Config) { d.ParanoiaWindow = s.ParanoiaWindow }},
+	{"paranoia-samples", func(d, s *watch.Config) { d.ParanoiaSamples = s.ParanoiaSamples }},
+	{"paranoia-max-wait", func(d, s *watch.Config) { d.ParanoiaMaxWait = s.ParanoiaMaxWait }},
+	{"dedup", func(d, s *watch.Config) { d.Dedup = s.Dedup }},
+	{"dedup-retention", func(d, s *watch.Config) { d.DedupRetention = s.DedupRetention }},
+	{"duplicate-dir", func(d, s *watch.Config) { d.DuplicateDir = s.DuplicateDir }},
+	{"process-existing", func(d, s *watch.Config) { d.ProcessExistingFiles = s.ProcessExistingFiles }},
+	{"recursive", func(d, s *watch.Config) { d.Recursive = s.Recursive }},
+	{"backend", func(d, s *watch.Config) { d.Backend = s.Backend }},
+	{"poll-interval", func(d, s *watch.Config) { d.PollInterval = s.PollInterval }},
+	{"rescan-interval", func(d, s *watch.Config) { d.RescanInterval = s.RescanInterval }},
+	{"rescan-age", func(d, s *watch.Config) { d.RescanAge = s.RescanAge }},
+	{"include", func(d, s *watch.Config) { d.Include = s.Include }},
+	{"exclude", func(d, s *watch.Config) { d.Exclude = s.Exclude }},
+	{"workers", func(d, s *watch.Config) { d.Workers = s.Workers }},
+	{"action-timeout", func(d, s *watch.Config) { d.ActionTimeout = s.ActionTimeout }},
+	{"retries", func(d, s *watch.Config) { d.Retry.MaxAttempts = s.Retry.MaxAttempts }},
+	{"retry-delay", func(d, s *watch.Config) { d.Retry.InitialDelay = s.Retry.InitialDelay }},
+	{"state-dir", func(d, s *watch.Config) { d.StateDir = s.StateDir }},
+	{"shutdown-timeout", func(d, s *watch.Config) { d.ShutdownTimeout = s.ShutdownTimeout }},
+	{"debug", func(d, s *watch.Config) { d.Debug = s.Debug }},
+	{"log-errors", func(d, s *watch.Config) { d.ReportErrors = s.ReportErrors }},
+	{"log-actions", func(d, s *watch.Config) { d.ReportActions = s.ReportActions }},
+}
+
+/*
+  Load the config file over cfg, apart from anything given explicitly on the
+  command line.
+*/
+func loadConfigFile(cfg *watch.Config, c *cli.Context, path string) error {
+	merged := *cfg
+	if err := watch.LoadConfigInto(path, &merged); err != nil {
+		return err
+	}
+	for _, f := range flagFields {
+		if c.GlobalIsSet(f.flag) {
+			f.copy(&merged, cfg)
+		}
+	}
+	*cfg = merged
+	return nil
+}
+
+/*
+  The pipelines in the config file, if it has any, with anything given
+  explicitly on the command line applied to every one of them. A --state-dir
+  is shared, so as in the file each pipeline gets its own directory in it.
+*/
+func loadPipelines(cfg *watch.Config, c *cli.Context, path string) ([]*watch.Config, error) {
+	pipelines, err := watch.LoadPipelines(path, cfg)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range pipelines {
+		for _, f := range flagFields {
+			if c.GlobalIsSet(f.flag) {
+				f.copy(p, cfg)
+			}
+		}
+		if c.GlobalIsSet("state-dir") && cfg.StateDir != "" {
+			p.StateDir = watch.PipelineStateDir(cfg.StateDir, p.Name)
+		}
+	}
+	return pipelines, nil
 }
 
 func globalFlags(cfg *watch.Config) (f []cli.Flag) {
 
 	f = []cli.Flag{
+		cli.StringFlag{
+			Name:  "config",
+			Usage: "Load settings (including actions) from this YAML, TOML or JSON file. Flags given on the command line override the file. With a config file which has actions (or pipelines, to watch several directories) you don't need an action command, just run springboard --config FILE",
+		},
 		cli.StringFlag{
 			Name:        "archive",
 			Usage:       "move the file to this location after successful action",
@@ -89,14 +185,133 @@ func globalFlags(cfg *watch.Config) (f []cli.Flag) {
 		},
 		cli.StringFlag{
 			Name:  "paranoia",
-			Usage: "Do we take extra steps to ensure the file has been completely written? See documentation for full details. Values: off, basic, extra.",
+			Usage: "Do we take extra steps to ensure the file has been completely written? See documentation for full details. Values: off, basic, extra, marker, events, stable.",
 			Value: "basic",
 		},
+		cli.StringSliceFlag{
+			Name:  "marker-suffix",
+			Usage: "With --paranoia marker, foo.xml is processed once foo.xml plus this suffix appears. Can be used repeatedly, default .done and .ok",
+			Value: (*cli.StringSlice)(&cfg.MarkerSuffixes),
+		},
+		cli.BoolFlag{
+			Name:        "archive-markers",
+			Usage:       "With --paranoia marker, move markers to the archive or error directory along with their files instead of deleting them.",
+			Destination: &cfg.ArchiveMarkers,
+		},
+		cli.DurationFlag{
+			Name:        "quiet-period",
+			Usage:       "With --paranoia events, how long a file has to go without being written to before it's processed.",
+			Value:       watch.DefaultQuietPeriod,
+			Destination: &cfg.QuietPeriod,
+		},
+		cli.DurationFlag{
+			Name:        "paranoia-window",
+			Usage:       "With --paranoia stable, how often to look at the file's size.",
+			Value:       watch.DefaultParanoiaWindow,
+			Destination: &cfg.ParanoiaWindow,
+		},
+		cli.IntFlag{
+			Name:        "paranoia-samples",
+			Usage:       "With --paranoia stable, how many looks in a row have to find the file the same size (and with the same modification time) before it's processed.",
+			Value:       watch.DefaultParanoiaSamples,
+			Destination: &cfg.ParanoiaSamples,
+		},
+		cli.DurationFlag{
+			Name:        "paranoia-max-wait",
+			Usage:       "Give up on a file which still doesn't look finished after this long, and send it to the error directory. Default is to wait as long as it takes.",
+			Destination: &cfg.ParanoiaMaxWait,
+		},
+		cli.BoolFlag{
+			Name:        "dedup",
+			Usage:       "Don't process files with the same content as one already processed successfully. Duplicates are deleted, or see --duplicate-dir. Use with --state-dir to remember what's been processed across restarts.",
+			Destination: &cfg.Dedup,
+		},
+		cli.DurationFlag{
+			Name:        "dedup-retention",
+			Usage:       "With --dedup, how long to remember a file's content for.",
+			Value:       watch.DefaultDedupRetention,
+			Destination: &cfg.DedupRetention,
+		},
+		cli.StringFlag{
+			Name:        "duplicate-dir",
+			Usage:       "With --dedup, move duplicates here rather than deleting them.",
+			Destination: &cfg.DuplicateDir,
+		},
 		cli.BoolFlag{
 			Name:        "process-existing",
 			Usage:       "Process any pre-existing files in the directory on startup. Obviously best used alongside an archive option of some kind.",
 			Destination: &cfg.ProcessExistingFiles,
 		},
+		cli.BoolFlag{
+			Name:        "recursive",
+			Usage:       "Also watch subdirectories of the directory, including ones created while we're running. Archive and error directories inside the watched directory are left alone.",
+			Destination: &cfg.Recursive,
+		},
+		cli.StringFlag{
+			Name:        "backend",
+			Usage:       "How to find out about new files: fsnotify (events from the operating system) or poll (list the directory every --poll-interval, for network filesystems which don't deliver events).",
+			Value:       watch.FsnotifyBackend,
+			Destination: &cfg.Backend,
+		},
+		cli.DurationFlag{
+			Name:        "poll-interval",
+			Usage:       "With --backend poll, how often to list the directory.",
+			Value:       watch.DefaultPollInterval,
+			Destination: &cfg.PollInterval,
+		},
+		cli.DurationFlag{
+			Name:        "rescan-interval",
+			Usage:       "Look through the directory this often for files we've missed (eg because the operating system dropped events under load). Off by default.",
+			Destination: &cfg.RescanInterval,
+		},
+		cli.DurationFlag{
+			Name:        "rescan-age",
+			Usage:       "With --rescan-interval, only pick up missed files which haven't been modified for this long.",
+			Value:       watch.DefaultRescanAge,
+			Destination: &cfg.RescanAge,
+		},
+		cli.StringSliceFlag{
+			Name:  "include",
+			Usage: "Only process files matching this pattern. Patterns are globs (*.xml) or regular expressions prefixed with re: (re:^order-[0-9]+\\.xml$). Can be used repeatedly, a file matching any of them is included.",
+			Value: (*cli.StringSlice)(&cfg.Include),
+		},
+		cli.StringSliceFlag{
+			Name:  "exclude",
+			Usage: "Never process files matching this pattern, same format as --include. Can be used repeatedly.",
+			Value: (*cli.StringSlice)(&cfg.Exclude),
+		},
+		cli.IntFlag{
+			Name:        "workers",
+			Usage:       "How many files to process at once. Further files queue up and are processed in the order they arrived.",
+			Value:       watch.DefaultWorkers,
+			Destination: &cfg.Workers,
+		},
+		cli.DurationFlag{
+			Name:        "action-timeout",
+			Usage:       "Give up on an action (and treat it as failed) if it takes longer than this, eg 30s. Default is no limit, although post has its own --timeout.",
+			Destination: &cfg.ActionTimeout,
+		},
+		cli.IntFlag{
+			Name:  "retries",
+			Usage: "How many times to retry a file when an action fails in a way which might work next time (eg the server we're posting to is down). Waits between attempts double each time.",
+		},
+		cli.DurationFlag{
+			Name:        "retry-delay",
+			Usage:       "How long to wait before the first retry.",
+			Value:       watch.DefaultRetryDelay,
+			Destination: &cfg.Retry.InitialDelay,
+		},
+		cli.StringFlag{
+			Name:        "state-dir",
+			Usage:       "Keep track of files in progress, waiting to be retried or which have failed in this directory, so that springboard carries on where it left off after a restart or crash.",
+			Destination: &cfg.StateDir,
+		},
+		cli.DurationFlag{
+			Name:        "shutdown-timeout",
+			Usage:       "On SIGINT or SIGTERM, how long to wait for files currently being processed before giving up on them. A second signal stops immediately.",
+			Value:       30 * time.Second,
+			Destination: &cfg.ShutdownTimeout,
+		},
 		cli.BoolFlag{
 			Name:        "debug",
 			Usage:       "enable verbose debug output",
@@ -122,28 +337,274 @@ func globalFlags(cfg *watch.Config) (f []cli.Flag) {
 }
 
 func run_watch(c *watch.Config) {
-	e := watch.Watch(c)
+	w, e := watch.NewWatcher(c)
+	if e == nil {
+		stopOnSignal(w, c.ShutdownTimeout)
+		e = w.Run()
+	}
+	if e != nil {
+		fmt.Fprintln(os.Stderr, e)
+	}
+}
+
+/*
+  Run the pipelines from a config file side by side until we get a signal.
+*/
+func run_pipelines(pipelines []*watch.Config, timeout time.Duration) {
+	m, e := watch.NewManager()
+	for i := 0; e == nil && i < len(pipelines); i++ {
+		e = m.Add(pipelines[i])
+	}
+	if e == nil {
+		stopOnSignal(m, timeout)
+		if e = m.StartAll(); e == nil {
+			m.Wait()
+		} else {
+			m.Shutdown(context.Background())
+		}
+	}
+	if e != nil {
+		fmt.Fprintln(os.Stderr, e)
+		os.Exit(1)
+	}
+}
+
+/* A watcher or a manager */
+type shutdowner interface {
+	Shutdown(ctx context.Context) ([]string, error)
+}
+
+/*
+  On SIGINT / SIGTERM shutdown the watcher cleanly, letting files in progress
+  finish. Another signal while we're waiting gives up straight away.
+*/
+func stopOnSignal(w shutdowner, timeout time.Duration) {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		sig := <-signals
+		fmt.Fprintln(os.Stderr, "Got", sig, "shutting down, waiting up to", timeout, "for files in progress")
+
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		go func() {
+			<-signals
+			cancel()
+		}()
+
+		unprocessed, err := w.Shutdown(ctx)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Shutdown did not complete:", err)
+		}
+		for _, path := range unprocessed {
+			fmt.Fprintln(os.Stderr, "Left unprocessed:", path)
+		}
+	}()
+}
+
+/*
+  The redrive command takes the same action subcommands as a normal run, but
+  the directory they're given is the error directory to redrive.
+*/
+func redrive_command(cfg *watch.Config) cli.Command {
+	var opts watch.RedriveOptions
+	redrive := func(c *watch.Config) {
+		opts.ErrorDir = c.Dir
+		run_redrive(c, opts)
+	}
+
+	return cli.Command{
+		Name: "redrive",
+		Action: wrapCmd(cfg, cli.Command{
+			Action: func(c *cli.Context) {
+				/* No action command, use the actions from the config file */
+				pipelines, err := configPipelines(cfg, c)
+				if err != nil {
+					fmt.Fprintln(os.Stderr, "Could not load config:", err)
+					os.Exit(1)
+				}
+				if pipelines != nil {
+					for _, p := range pipelines {
+						if p.ErrorDir != "" && len(p.Actions) > 0 {
+							fmt.Fprintln(os.Stderr, "Pipeline", p.Name)
+							run_redrive(p, opts)
+						}
+					}
+					return
+				}
+				if len(cfg.Actions) == 0 {
+					cli.ShowSubcommandHelp(c)
+					os.Exit(1)
+				}
+				run_redrive(cfg, opts)
+			},
+		}).Action,
+		Usage: "Have another go at the files in an error directory, using one of the usual actions. Files which work are moved to the archive directory (so --archive is required), ones which fail are left where they are. Eg: springboard --archive ARCHIVE redrive post URL ERRORDIR. With a config file just springboard --config FILE redrive, to redrive its error directory with its actions.",
+		Flags: []cli.Flag{
+			cli.StringSliceFlag{
+				Name:  "match",
+				Usage: "Only redrive files matching this pattern (same format as --include). Can be used repeatedly.",
+				Value: (*cli.StringSlice)(&opts.Include),
+			},
+			cli.DurationFlag{
+				Name:        "older-than",
+				Usage:       "Only redrive files last modified at least this long ago, eg 1h.",
+				Destination: &opts.OlderThan,
+			},
+		},
+		Subcommands: []cli.Command{
+			wrapCmd(cfg, http_post_command(cfg, redrive)),
+			wrapCmd(cfg, echo_command(cfg, redrive)),
+			wrapCmd(cfg, run_command(cfg, redrive)),
+		},
+	}
+}
+
+func run_redrive(c *watch.Config, opts watch.RedriveOptions) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	go func() {
+		<-signals
+		cancel()
+	}()
+
+	report, e := watch.Redrive(ctx, c, opts)
+	if report != nil {
+		fmt.Fprintln(os.Stderr, "Redrive:", len(report.Succeeded), "succeeded,", len(report.Failed), "failed,", len(report.Skipped), "skipped")
+		for _, path := range report.Failed {
+			fmt.Fprintln(os.Stderr, "Failed:", path)
+		}
+	}
 	if e != nil {
 		fmt.Fprintln(os.Stderr, e)
 	}
 }
 
+/*
+  What we do with no command: run whatever the config file says.
+*/
+func config_command(cfg *watch.Config) cli.Command {
+	return cli.Command{
+		Action: func(c *cli.Context) {
+			pipelines, err := configPipelines(cfg, c)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "Could not load config:", err)
+				os.Exit(1)
+			}
+			if pipelines != nil {
+				run_pipelines(pipelines, cfg.ShutdownTimeout)
+				return
+			}
+			if c.GlobalString("config") == "" || len(cfg.Actions) == 0 || cfg.Dir == "" {
+				cli.ShowAppHelp(c)
+				os.Exit(1)
+			}
+			run_watch(cfg)
+		},
+	}
+}
+
+/* The pipelines in the --config file, nil if there's no file or it doesn't have any */
+func configPipelines(cfg *watch.Config, c *cli.Context) ([]*watch.Config, error) {
+	path := c.GlobalString("config")
+	if path == "" {
+		return nil, nil
+	}
+	return loadPipelines(cfg, c, path)
+}
+
+func validate_config_command(cfg *watch.Config) cli.Command {
+	return wrapCmd(cfg, cli.Command{
+		Name:  "validate-config",
+		Usage: "Check the file given with --config (and any other flags) make a usable configuration, without running anything.",
+		Action: func(c *cli.Context) {
+			if c.GlobalString("config") == "" {
+				fmt.Fprintln(os.Stderr, "No config file, use --config FILE")
+				os.Exit(1)
+			}
+			pipelines, err := configPipelines(cfg, c)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "Invalid config:", err)
+				os.Exit(1)
+			}
+			if pipelines != nil {
+				if err := watch.CheckPipelines(pipelines); err != nil {
+					fmt.Fprintln(os.Stderr, "Invalid config:", err)
+					os.Exit(1)
+				}
+				fmt.Println("Config OK:", len(pipelines), "pipeline(s)")
+				return
+			}
+			if err := cfg.Validate(); err != nil {
+				fmt.Fprintln(os.Stderr, "Invalid config:", err)
+				os.Exit(1)
+			}
+			fmt.Println("Config OK: watching", cfg.Dir, "with", len(cfg.Actions), "action(s)")
+		},
+	})
+}
+
 func http_post_command(cfg *watch.Config, action func(*watch.Config)) cli.Command {
 	var pa watch.PostAction
-	//	var http_headers cli.StringSlice
+	var http_headers cli.StringSlice
+	var mime_map cli.StringSlice
+	var form_fields cli.StringSlice
+	var success_codes string
 	return cli.Command{
 		Name:  "post",
 		Usage: "post the file somewhere - using an HTTP POST",
 		Flags: []cli.Flag{
-			// cli.StringSliceFlag{
-			// 	Name:  "header",
-			// 	Value: &http_headers,
-			// 	Usage: "Set extra http headers, format is KEY:VAL",
-			// },
+			cli.StringFlag{
+				Name:        "method",
+				Destination: &pa.Method,
+				Value:       watch.PostMethods[0],
+				Usage:       "The HTTP method to send the file with: " + strings.Join(watch.PostMethods, ", "),
+			},
+			cli.StringFlag{
+				Name:        "success-codes",
+				Destination: &success_codes,
+				Value:       watch.DefaultSuccessCodes.String(),
+				Usage:       "The response codes which mean the server has the file, eg 200-299,409. Server errors (5xx) and 429 responses are retried (see --retries), anything else is a permanent failure.",
+			},
+			cli.StringSliceFlag{
+				Name:  "header",
+				Value: &http_headers,
+				Usage: "Set extra http headers, format is KEY:VAL. Can be used repeatedly. VAL can use the file's details, eg X-Filename:{{.Name}}, see documentation for the full list.",
+			},
 			cli.StringFlag{
 				Name:        "mime",
 				Destination: &pa.Mime,
-				Usage:       "Force the mime type on the post",
+				Usage:       "Force the mime type on the post. Without this the type is worked out from the file's extension (see --mime-map) or content.",
+			},
+			cli.StringSliceFlag{
+				Name:  "mime-map",
+				Value: &mime_map,
+				Usage: "Send files with this extension as this mime type, format is EXT=TYPE, eg xml=application/xml. Can be used repeatedly.",
+			},
+			cli.BoolFlag{
+				Name:        "multipart",
+				Destination: &pa.Multipart,
+				Usage:       "Upload the file as an HTML form would (multipart/form-data), rather than sending it as the whole body.",
+			},
+			cli.StringFlag{
+				Name:        "field-name",
+				Destination: &pa.FieldName,
+				Value:       watch.DefaultFieldName,
+				Usage:       "With --multipart, the form field to put the file in.",
+			},
+			cli.StringFlag{
+				Name:        "upload-name",
+				Destination: &pa.UploadName,
+				Usage:       "With --multipart, the filename to give the server. Can use the file's details like --header, eg {{.Name}}.bak. Default is the file's own name.",
+			},
+			cli.StringSliceFlag{
+				Name:  "form",
+				Value: &form_fields,
+				Usage: "With --multipart, send this form field as well, format is KEY=VAL. VAL can use the file's details like --header. Can be used repeatedly.",
 			},
 			cli.StringFlag{
 				Name:        "uname",
@@ -155,8 +616,15 @@ func http_post_command(cfg *watch.Config, action func(*watch.Config)) cli.Comman
 				Destination: &pa.BasicAuthPwd,
 				Usage:       "Set the password for HTTP basic auth.",
 			},
+			cli.DurationFlag{
+				Name:        "timeout",
+				Destination: &pa.Timeout,
+				Value:       watch.DefaultPostTimeout,
+				Usage:       "Give up on the request if it takes longer than this.",
+			},
 		},
-		ArgsUsage: "URL DIR",
+		ArgsUsage:   "URL DIR",
+		Description: "URL can use details of the file being sent, eg https://my.server.com/files/{{.Name}}?size={{.Size}}. See documentation for the full list.",
 		Action: func(c *cli.Context) {
 
 			args := c.Args()
@@ -182,6 +650,61 @@ func http_post_command(cfg *watch.Config, action func(*watch.Config)) cli.Comman
 
 			pa.To = next()
 
+			method, err := watch.ParseMethod(pa.Method)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				bail()
+			}
+			pa.Method = method
+
+			codes, err := watch.ParseStatusCodes(success_codes)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				bail()
+			}
+			pa.SuccessCodes = codes
+
+			for _, header := range http_headers {
+				key, val, err := watch.ParseHeader(header)
+				if err != nil {
+					fmt.Fprintln(os.Stderr, err)
+					bail()
+				}
+				if pa.Headers == nil {
+					pa.Headers = make(map[string]string)
+				}
+				pa.Headers[key] = val
+			}
+
+			for _, mapping := range mime_map {
+				ext, mime_type, err := watch.ParseMimeMapping(mapping)
+				if err != nil {
+					fmt.Fprintln(os.Stderr, err)
+					bail()
+				}
+				if pa.MimeMap == nil {
+					pa.MimeMap = make(map[string]string)
+				}
+				pa.MimeMap[ext] = mime_type
+			}
+
+			for _, field := range form_fields {
+				key, val, err := watch.ParseFormField(field)
+				if err != nil {
+					fmt.Fprintln(os.Stderr, err)
+					bail()
+				}
+				if pa.Form == nil {
+					pa.Form = make(map[string]string)
+				}
+				pa.Form[key] = val
+			}
+
+			if err := pa.Check(); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				bail()
+			}
+
 			cfg.Actions = []watch.Action{
 				&pa,
 			}
@@ -235,6 +758,11 @@ func run_command(cfg *watch.Config, action func(*watch.Config)) cli.Command {
 				Usage: "Add arguments which are run after the filename in the command we build. So if you were doing a cp: ./springboard run --postarg /some/place cp\nNote that you can use postarg repeatedly to add more arguments.",
 				Value: (*cli.StringSlice)(&ra.PostArgs),
 			},
+			cli.IntSliceFlag{
+				Name:  "retry-exit-code",
+				Usage: "An exit code which means the command should be retried later (see --retries), any other failure is permanent. Can be repeated.",
+				Value: (*cli.IntSlice)(&ra.RetryExitCodes),
+			},
 		},
 		Action: func(c *cli.Context) {
 
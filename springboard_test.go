@@ -5,6 +5,7 @@ import (
 	"github.com/draxil/springboard/watch"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 	"net/http"
@@ -43,7 +44,10 @@ func Test_http_post_command_opts(t *testing.T) {
 		}),
 	}
 	is := makeIs(t)
-	app.Run([]string{"", "post", "--uname", "x", "--pass", "y", "--mime=x/y", "http://goo.com", "x"})
+	app.Run([]string{"", "post", "--uname", "x", "--pass", "y", "--mime=x/y", "--timeout=3s",
+		"--header", "X-Filename: {{.Name}}", "--header=X-Source:springboard",
+		"--mime-map", "po=application/purchase-order", "--multipart", "--form", "source={{.Name}}",
+		"--method=put", "--success-codes=200-299,409", "http://goo.com", "x"})
 	is(posted, true, "Post executed")
 	is(len(ourWc.Actions), 1, "One action generated")
 	a := ourWc.Actions[0]
@@ -54,6 +58,16 @@ func Test_http_post_command_opts(t *testing.T) {
 	is(pa.BasicAuthUsername, "x", "BasicAuthUsername")
 	is(pa.BasicAuthPwd, "y", "BasicAuthPwd")
 	is(pa.Mime, "x/y", "Mime")
+	is(pa.Timeout, 3*time.Second, "Timeout")
+	is(len(pa.Headers), 2, "Headers")
+	is(pa.Headers["X-Filename"], "{{.Name}}", "Header template")
+	is(pa.Headers["X-Source"], "springboard", "Header")
+	is(pa.MimeMap["po"], "application/purchase-order", "Mime map")
+	is(pa.Multipart, true, "Multipart")
+	is(pa.FieldName, watch.DefaultFieldName, "Default field name")
+	is(pa.Form["source"], "{{.Name}}", "Form field")
+	is(pa.Method, "PUT", "Method")
+	is(pa.SuccessCodes.String(), "200-299,409", "Success codes")
 }
 
 func Test_glob_opts(t *testing.T) {
@@ -67,6 +81,9 @@ func Test_glob_opts(t *testing.T) {
 		is(ourWc.ProcessExistingFiles, false, "process existing off")
 		is(ourWc.ReportErrors, true, "Error reportin on by default")
 		is(ourWc.ReportActions, false, "Action reporting on by default");
+		is(ourWc.Recursive, false, "recursive off")
+		is(ourWc.Workers, watch.DefaultWorkers, "default workers")
+		is(ourWc.ShutdownTimeout, 30*time.Second, "default shutdown timeout")
 		if ourWc.Paranoia != watch.NoParanoia {
 			t.Fatal("unexpected paranoia")
 		}
@@ -76,16 +93,98 @@ func Test_glob_opts(t *testing.T) {
 		var ourWc watch.Config
 		app.Flags = globalFlags( &ourWc )
 		is := makeIs(t)
-		app.Run([]string{"", "--archive=FISHBOWL", "--error-dir=CATBASKET", "--debug", "--log-actions", "--log-errors=false", "--process-existing"})
+		app.Run([]string{"", "--archive=FISHBOWL", "--error-dir=CATBASKET", "--debug", "--log-actions", "--log-errors=false", "--process-existing", "--recursive",
+			"--include=*.xml", "--include=re:^a", "--exclude=*.tmp", "--workers=12", "--shutdown-timeout=5s", "--action-timeout=1m",
+			"--state-dir=STATE", "--marker-suffix=.ready", "--archive-markers", "--quiet-period=3s",
+			"--paranoia-window=2s", "--paranoia-samples=5", "--paranoia-max-wait=1h", "--dedup", "--duplicate-dir=DUPES",
+			"--backend=poll", "--poll-interval=10s", "--rescan-interval=1m"})
 		is(ourWc.ArchiveDir, "FISHBOWL", "archive dir")
 		is(ourWc.ErrorDir, "CATBASKET", "error dir")
 		is(ourWc.Debug, true, "debug on")
 		is(ourWc.ReportActions, true, "action reporting on")
 		is(ourWc.ReportErrors, false, "error reporting off")
 		is(ourWc.ProcessExistingFiles, true, "process existing on")
+		is(ourWc.Recursive, true, "recursive on")
+		is(len(ourWc.Include), 2, "two includes")
+		is(ourWc.Include[1], "re:^a", "regex include")
+		is(len(ourWc.Exclude), 1, "one exclude")
+		is(ourWc.Exclude[0], "*.tmp", "glob exclude")
+		is(ourWc.Workers, 12, "workers")
+		is(ourWc.ShutdownTimeout, 5*time.Second, "shutdown timeout")
+		is(ourWc.ActionTimeout, time.Minute, "action timeout")
+		is(ourWc.StateDir, "STATE", "state dir")
+		is(ourWc.MarkerSuffixes[0], ".ready", "marker suffix")
+		is(ourWc.ArchiveMarkers, true, "archive markers")
+		is(ourWc.QuietPeriod, 3*time.Second, "quiet period")
+		is(ourWc.ParanoiaWindow, 2*time.Second, "paranoia window")
+		is(ourWc.ParanoiaSamples, 5, "paranoia samples")
+		is(ourWc.ParanoiaMaxWait, time.Hour, "paranoia max wait")
+		is(ourWc.Dedup, true, "dedup")
+		is(ourWc.DuplicateDir, "DUPES", "duplicate dir")
+		is(ourWc.DedupRetention, watch.DefaultDedupRetention, "default dedup retention")
+		is(ourWc.Backend, watch.PollBackend, "backend")
+		is(ourWc.PollInterval, 10*time.Second, "poll interval")
+		is(ourWc.RescanInterval, time.Minute, "rescan interval")
+		is(ourWc.RescanAge, watch.DefaultRescanAge, "default rescan age")
 	}
 }
 
+func Test_setup_action(t *testing.T) {
+	app := cli.NewApp()
+	var ourWc watch.Config
+	app.Flags = globalFlags(&ourWc)
+	app.Action = func(c *cli.Context) {
+		setupAction(&ourWc, c)
+	}
+	is := makeIs(t)
+	app.Run([]string{"", "--retries=3", "--retry-delay=5s", "--paranoia=extra"})
+	is(ourWc.Retry.MaxAttempts, 4, "retries are on top of the first attempt")
+	is(ourWc.Retry.InitialDelay, 5*time.Second, "retry delay")
+	if ourWc.Paranoia != watch.ExtraParanoia {
+		t.Fatal("unexpected paranoia")
+	}
+}
+
+func Test_config_file(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "springboard")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	path := tempDir + string(os.PathSeparator) + "springboard.yaml"
+	ioutil.WriteFile(path, []byte(`
+dir: /in
+archive_dir: /file-archive
+error_dir: /file-errors
+workers: 9
+paranoia: extra
+actions:
+  - type: echo
+`), 0666)
+
+	app := cli.NewApp()
+	var ourWc watch.Config
+	app.Flags = globalFlags(&ourWc)
+	app.Action = func(c *cli.Context) {
+		setupAction(&ourWc, c)
+	}
+	is := makeIs(t)
+	app.Run([]string{"", "--config", path, "--archive=/flag-archive", "--paranoia=off"})
+	is(ourWc.Dir, "/in", "dir from file")
+	is(ourWc.ArchiveDir, "/flag-archive", "flag overrides file")
+	is(ourWc.ErrorDir, "/file-errors", "error dir from file")
+	is(ourWc.Workers, 9, "file overrides flag default")
+	is(ourWc.ShutdownTimeout, 30*time.Second, "flag default kept when not in the file")
+	is(ourWc.ReportErrors, true, "flag default kept for booleans")
+	if ourWc.Paranoia != watch.NoParanoia {
+		t.Fatal("paranoia flag should override file")
+	}
+	is(len(ourWc.Actions), 1, "actions from file")
+	_, ok := ourWc.Actions[0].(*watch.EchoAction)
+	is(ok, true, "echo action")
+}
+
 func TestRunSimpleEcho(t *testing.T){
 	app := app()
 	mkTempDir := func()(string){
@@ -302,6 +401,46 @@ func TestPostargRun(t *testing.T){
 }
 
 
+func TestRedrive(t *testing.T) {
+	app := app()
+	mkTempDir := func() string {
+		s, e := ioutil.TempDir("", "springboard")
+		if e != nil {
+			panic(e)
+		}
+		return s
+	}
+
+	errDir := mkTempDir()
+	archDir := mkTempDir()
+	defer func() {
+		os.RemoveAll(errDir)
+		os.RemoveAll(archDir)
+	}()
+
+	sep := string(os.PathSeparator)
+	old := time.Now().Add(-2 * time.Hour)
+	for _, v := range []string{"a.xml", "b.txt", "c.xml"} {
+		if _, err := os.Create(errDir + sep + v); err != nil {
+			panic(err)
+		}
+		if v != "c.xml" {
+			os.Chtimes(errDir+sep+v, old, old)
+		}
+	}
+
+	app.Run([]string{"", "--archive=" + archDir, "--paranoia=off",
+		"redrive", "--match=*.xml", "--older-than=1h", "run", "/bin/true", errDir})
+
+	is := makeIs(t)
+	_, fe := os.Stat(archDir + sep + "a.xml")
+	is(fe, nil, "old matching file redriven")
+	for _, v := range []string{"b.txt", "c.xml"} {
+		_, fe = os.Stat(errDir + sep + v)
+		is(fe, nil, v+" left in the error dir")
+	}
+}
+
 func TestParanoia(t *testing.T){
 	skipLong(t)
 	app := app()
@@ -404,3 +543,50 @@ func makeIs(t *testing.T) func(interface{}, interface{}, string) {
 		}
 	}
 }
+
+func Test_config_pipelines(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "springboard")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	path := tempDir + string(os.PathSeparator) + "springboard.yaml"
+	ioutil.WriteFile(path, []byte(`
+workers: 9
+actions:
+  - type: echo
+pipelines:
+  - name: a
+    dir: /a
+    archive_dir: /a-archive
+  - name: b
+    dir: /b
+    workers: 2
+`), 0666)
+
+	app := cli.NewApp()
+	var ourWc watch.Config
+	var pipelines []*watch.Config
+	app.Flags = globalFlags(&ourWc)
+	app.Action = func(c *cli.Context) {
+		setupAction(&ourWc, c)
+		pipelines, err = configPipelines(&ourWc, c)
+	}
+	is := makeIs(t)
+	app.Run([]string{"", "--config", path, "--archive=/flag-archive"})
+	is(err, nil, "loaded")
+	is(len(pipelines), 2, "two pipelines")
+	is(pipelines[0].Dir, "/a", "first dir")
+	is(pipelines[0].ArchiveDir, "/flag-archive", "flag overrides pipeline")
+	is(pipelines[1].ArchiveDir, "/flag-archive", "flag applies to every pipeline")
+	is(pipelines[0].Workers, 9, "top level default")
+	is(pipelines[1].Workers, 2, "pipeline overrides top level")
+	is(pipelines[1].ShutdownTimeout, 30*time.Second, "flag default kept")
+
+	app.Run([]string{"", "--config", path, "--state-dir=/flag-state"})
+	is(err, nil, "loaded with a state dir")
+	is(pipelines[0].StateDir, filepath.Join("/flag-state", "a"), "own directory in the flag's state dir")
+	is(pipelines[1].StateDir, filepath.Join("/flag-state", "b"), "each pipeline its own")
+	is(watch.CheckPipelines(pipelines), nil, "pipelines can run together")
+}
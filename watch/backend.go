@@ -0,0 +1,297 @@
+package watch
+
+import (
+	"fmt"
+	"gopkg.in/fsnotify.v1"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+/* Config.Backend values */
+const (
+	FsnotifyBackend = "fsnotify" /* Events from the operating system, the default */
+	PollBackend     = "poll"     /* List the directories every Config.PollInterval */
+)
+
+/* How often PollBackend looks unless Config.PollInterval says otherwise */
+const DefaultPollInterval = 5 * time.Second
+
+/*
+  Where a watcher's filesystem events come from. Events are fsnotify's
+  whichever backend is in use: Create for a new file or directory, Write
+  when one changes, Remove (or Rename) when one goes away. An error on
+  Errors stops the watcher.
+*/
+type Backend interface {
+	Add(dir string) error    /* Start watching the files in dir (not below it) */
+	Remove(dir string) error /* Stop watching dir */
+	Events() <-chan fsnotify.Event
+	Errors() <-chan error
+	Close() error /* Stop watching everything, closing Events & Errors */
+}
+
+/* The backend the config asks for, warn gets any problems which aren't fatal */
+func newBackend(c *Config, warn func(things ...interface{})) (Backend, error) {
+	switch c.Backend {
+	case "", FsnotifyBackend:
+		return newFsnotifyBackend()
+	case PollBackend:
+		return newPollBackend(c.PollInterval, warn), nil
+	}
+	return nil, fmt.Errorf("unknown backend %q", c.Backend)
+}
+
+/*
+  The operating system's own file events, via fsnotify. These are immediate
+  but don't work everywhere, in particular network filesystems (NFS, SMB)
+  and FUSE mounts usually don't deliver them.
+*/
+type fsnotifyBackend struct {
+	*fsnotify.Watcher
+}
+
+func newFsnotifyBackend() (*fsnotifyBackend, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	return &fsnotifyBackend{watcher}, nil
+}
+
+func (b *fsnotifyBackend) Events() <-chan fsnotify.Event {
+	return b.Watcher.Events
+}
+
+func (b *fsnotifyBackend) Errors() <-chan error {
+	return b.Watcher.Errors
+}
+
+/*
+  Works anywhere we can list a directory: every interval each directory is
+  listed and compared with the last listing. New entries are Create events,
+  entries whose size or modification time changed are Write events and entries
+  which have gone are Remove events. A file which has been replaced by another
+  of the same name (a different inode, or a modification time going backwards)
+  is removed and created again, as fsnotify would tell us. A directory which
+  itself goes away gets a Remove event and is dropped. Any other failure to
+  list a directory (a network blip, say) is passed to warn and we try again
+  next time, rather than stopping the watcher.
+*/
+type pollBackend struct {
+	interval  time.Duration
+	warn      func(things ...interface{})
+	events    chan fsnotify.Event
+	errors    chan error
+	lock      sync.Mutex
+	dirs      map[string]map[string]pollEntry /* Last listing of each directory, by name */
+	done      chan struct{}
+	closeOnce sync.Once
+	stopped   sync.WaitGroup
+}
+
+/* What we saw of a directory entry last time */
+type pollEntry struct {
+	size    int64
+	modTime time.Time
+	dir     bool
+	id      uint64 /* The inode, where there is such a thing, otherwise 0 */
+}
+
+func newPollBackend(interval time.Duration, warn func(things ...interface{})) *pollBackend {
+	if interval <= 0 {
+		interval = DefaultPollInterval
+	}
+	b := &pollBackend{
+		interval: interval,
+		warn:     warn,
+		events:   make(chan fsnotify.Event),
+		errors:   make(chan error),
+		dirs:     make(map[string]map[string]pollEntry),
+		done:     make(chan struct{}),
+	}
+	b.stopped.Add(1)
+	go b.loop()
+	return b
+}
+
+func (b *pollBackend) Events() <-chan fsnotify.Event {
+	return b.events
+}
+
+func (b *pollBackend) Errors() <-chan error {
+	return b.errors
+}
+
+/*
+  Take the first listing of dir, anything already there isn't new.
+*/
+func (b *pollBackend) Add(dir string) error {
+	dir = filepath.Clean(dir)
+	listing, err := list(dir)
+	if err != nil {
+		return err
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if _, ok := b.dirs[dir]; !ok {
+		b.dirs[dir] = listing
+	}
+	return nil
+}
+
+func (b *pollBackend) Remove(dir string) error {
+	dir = filepath.Clean(dir)
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if _, ok := b.dirs[dir]; !ok {
+		return fmt.Errorf("not watching %s", dir)
+	}
+	delete(b.dirs, dir)
+	return nil
+}
+
+func (b *pollBackend) Close() error {
+	b.closeOnce.Do(func() {
+		close(b.done)
+		b.stopped.Wait()
+		close(b.events)
+		close(b.errors)
+	})
+	return nil
+}
+
+func (b *pollBackend) loop() {
+	defer b.stopped.Done()
+	ticker := time.NewTicker(b.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-b.done:
+			return
+		case <-ticker.C:
+			b.poll()
+		}
+	}
+}
+
+/*
+  List every directory we're watching and send events for what's changed.
+*/
+func (b *pollBackend) poll() {
+	b.lock.Lock()
+	dirs := make([]string, 0, len(b.dirs))
+	for dir := range b.dirs {
+		dirs = append(dirs, dir)
+	}
+	b.lock.Unlock()
+
+	for _, dir := range dirs {
+		listing, err := list(dir)
+		if os.IsNotExist(err) {
+			b.lock.Lock()
+			_, ok := b.dirs[dir]
+			delete(b.dirs, dir)
+			b.lock.Unlock()
+			if ok && !b.send(fsnotify.Event{Name: dir, Op: fsnotify.Remove}) {
+				return
+			}
+			continue
+		}
+		if err != nil {
+			b.warn("Could not list ", dir, ", will try again: ", err)
+			continue
+		}
+
+		b.lock.Lock()
+		last, ok := b.dirs[dir]
+		if ok {
+			b.dirs[dir] = listing
+		}
+		b.lock.Unlock()
+		if !ok {
+			/* Removed while we were listing it */
+			continue
+		}
+
+		for _, e := range changes(dir, last, listing) {
+			if !b.send(e) {
+				return
+			}
+		}
+	}
+}
+
+/* Send an event, unless we're closed first */
+func (b *pollBackend) send(e fsnotify.Event) bool {
+	select {
+	case b.events <- e:
+		return true
+	case <-b.done:
+		return false
+	}
+}
+
+func list(dir string) (map[string]pollEntry, error) {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	listing := make(map[string]pollEntry, len(fis))
+	for _, fi := range fis {
+		listing[fi.Name()] = pollEntry{size: fi.Size(), modTime: fi.ModTime(), dir: fi.IsDir(), id: fileID(fi)}
+	}
+	return listing, nil
+}
+
+/*
+  The events which get us from the before listing of dir to the after
+  listing, in name order. A file replaced by a directory (or the other way
+  round), or by a different file, is removed and created again.
+*/
+func changes(dir string, before, after map[string]pollEntry) (events []fsnotify.Event) {
+	for _, name := range sortedNames(before) {
+		if _, ok := after[name]; !ok {
+			events = append(events, fsnotify.Event{Name: filepath.Join(dir, name), Op: fsnotify.Remove})
+		}
+	}
+	for _, name := range sortedNames(after) {
+		e := after[name]
+		path := filepath.Join(dir, name)
+		was, ok := before[name]
+		switch {
+		case !ok:
+			events = append(events, fsnotify.Event{Name: path, Op: fsnotify.Create})
+		case was.dir != e.dir, !e.dir && replaced(was, e):
+			events = append(events, fsnotify.Event{Name: path, Op: fsnotify.Remove}, fsnotify.Event{Name: path, Op: fsnotify.Create})
+		case !e.dir && (was.size != e.size || !was.modTime.Equal(e.modTime)):
+			events = append(events, fsnotify.Event{Name: path, Op: fsnotify.Write})
+		}
+	}
+	return
+}
+
+/*
+  Is now a different file to was? Writing to a file never changes its inode
+  or winds its modification time back, but a new file renamed over it does.
+*/
+func replaced(was, now pollEntry) bool {
+	if was.id != 0 && now.id != 0 && was.id != now.id {
+		return true
+	}
+	return now.modTime.Before(was.modTime)
+}
+
+func sortedNames(listing map[string]pollEntry) []string {
+	names := make([]string, 0, len(listing))
+	for name := range listing {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
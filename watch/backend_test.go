@@ -0,0 +1,123 @@
+package watch
+
+import (
+	"gopkg.in/fsnotify.v1"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestPollBackend(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "springboard")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tempDir)
+	elsewhere, err := ioutil.TempDir("", "springboard")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(elsewhere)
+	sep := string(os.PathSeparator)
+	ioutil.WriteFile(tempDir+sep+"old", []byte("old"), 0666)
+
+	processed := make(chan string, 10)
+	cfg := Config{
+		dontBlock:    true,
+		Dir:          tempDir,
+		Recursive:    true,
+		Backend:      PollBackend,
+		PollInterval: 20 * time.Millisecond,
+		AfterFileAction: func(file string, result *Result) {
+			processed <- file
+		},
+	}
+	w, err := NewWatcher(&cfg)
+	if err != nil {
+		panic(err)
+	}
+	if err := w.Run(); err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	expect := func(path string) {
+		select {
+		case file := <-processed:
+			if file != path {
+				t.Fatal("expected ", path, " got ", file)
+			}
+		case <-time.After(time.Second):
+			t.Fatal(path, " not picked up")
+		}
+	}
+
+	ioutil.WriteFile(tempDir+sep+"new", []byte("new"), 0666)
+	expect(tempDir + sep + "new")
+
+	/* Replaced in one go, between polls, is still a new file */
+	ioutil.WriteFile(elsewhere+sep+"new", []byte("newer"), 0666)
+	os.Rename(elsewhere+sep+"new", tempDir+sep+"new")
+	expect(tempDir + sep + "new")
+
+	/* New directories are polled too */
+	os.Mkdir(tempDir+sep+"sub", 0777)
+	time.Sleep(100 * time.Millisecond)
+	ioutil.WriteFile(tempDir+sep+"sub"+sep+"deeper", []byte("deeper"), 0666)
+	expect(tempDir + sep + "sub" + sep + "deeper")
+
+	select {
+	case file := <-processed:
+		t.Fatal("unexpected ", file)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestPollChanges(t *testing.T) {
+	is := makeIs(t)
+	now := time.Now()
+	before := map[string]pollEntry{
+		"same":     {size: 1, modTime: now},
+		"gone":     {size: 1, modTime: now},
+		"grown":    {size: 1, modTime: now},
+		"touched":  {size: 1, modTime: now},
+		"was_dir":  {dir: true},
+		"replaced": {size: 1, modTime: now, id: 1},
+		"older":    {size: 1, modTime: now},
+	}
+	after := map[string]pollEntry{
+		"same":     {size: 1, modTime: now},
+		"grown":    {size: 2, modTime: now},
+		"touched":  {size: 1, modTime: now.Add(time.Second)},
+		"was_dir":  {size: 1, modTime: now},
+		"new":      {size: 1, modTime: now},
+		"replaced": {size: 1, modTime: now.Add(time.Second), id: 2},
+		"older":    {size: 1, modTime: now.Add(-time.Second)},
+	}
+
+	events := changes("/in", before, after)
+	want := []fsnotify.Event{
+		{Name: "/in/gone", Op: fsnotify.Remove},
+		{Name: "/in/grown", Op: fsnotify.Write},
+		{Name: "/in/new", Op: fsnotify.Create},
+		{Name: "/in/older", Op: fsnotify.Remove},
+		{Name: "/in/older", Op: fsnotify.Create},
+		{Name: "/in/replaced", Op: fsnotify.Remove},
+		{Name: "/in/replaced", Op: fsnotify.Create},
+		{Name: "/in/touched", Op: fsnotify.Write},
+		{Name: "/in/was_dir", Op: fsnotify.Remove},
+		{Name: "/in/was_dir", Op: fsnotify.Create},
+	}
+	is(len(events), len(want), "number of events")
+	for i := range want {
+		is(events[i], want[i], want[i].String())
+	}
+}
+
+func TestUnknownBackend(t *testing.T) {
+	_, err := NewWatcher(&Config{Dir: "/in", Backend: "carrier-pigeon"})
+	if err == nil {
+		t.Fatal("unknown backend accepted")
+	}
+}
@@ -0,0 +1,484 @@
+package watch
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+/*
+  The names paranoia levels go by in config files and on the command line.
+*/
+var paranoiaNames = map[string]ParanoiaLevel{
+	"off":    NoParanoia,
+	"basic":  BasicParanoia,
+	"extra":  ExtraParanoia,
+	"marker": MarkerParanoia,
+	"events": EventParanoia,
+	"stable": StableParanoia,
+}
+
+func ParseParanoia(name string) (ParanoiaLevel, error) {
+	level, ok := paranoiaNames[name]
+	if !ok {
+		return NoParanoia, fmt.Errorf("unknown paranoia level %q", name)
+	}
+	return level, nil
+}
+
+func (p ParanoiaLevel) String() string {
+	for name, level := range paranoiaNames {
+		if level == p {
+			return name
+		}
+	}
+	return fmt.Sprintf("ParanoiaLevel(%d)", int(p))
+}
+
+/*
+  A duration in a config file, written the way time.ParseDuration likes, eg
+  "30s" or "1h30m".
+*/
+type fileDuration time.Duration
+
+func (d *fileDuration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("durations should be strings like \"30s\", got %s", b)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = fileDuration(parsed)
+	return nil
+}
+
+/*
+  The config file layout. Everything is a pointer so we can tell what the
+  file actually sets.
+*/
+type fileConfig struct {
+	Name            *string       `json:"name"`
+	Dir             *string       `json:"dir"`
+	ArchiveDir      *string       `json:"archive_dir"`
+	ErrorDir        *string       `json:"error_dir"`
+	StateDir        *string       `json:"state_dir"`
+	ProcessExisting *bool         `json:"process_existing"`
+	Recursive       *bool         `json:"recursive"`
+	Backend         *string       `json:"backend"`
+	PollInterval    *fileDuration `json:"poll_interval"`
+	RescanInterval  *fileDuration `json:"rescan_interval"`
+	RescanAge       *fileDuration `json:"rescan_age"`
+	Include         []string      `json:"include"`
+	Exclude         []string      `json:"exclude"`
+	Workers         *int          `json:"workers"`
+	Paranoia        *string       `json:"paranoia"`
+	MarkerSuffixes  []string      `json:"marker_suffixes"`
+	ArchiveMarkers  *bool         `json:"archive_markers"`
+	QuietPeriod     *fileDuration `json:"quiet_period"`
+	ParanoiaWindow  *fileDuration `json:"paranoia_window"`
+	ParanoiaSamples *int          `json:"paranoia_samples"`
+	ParanoiaMaxWait *fileDuration `json:"paranoia_max_wait"`
+	Dedup           *bool         `json:"dedup"`
+	DedupRetention  *fileDuration `json:"dedup_retention"`
+	DuplicateDir    *string       `json:"duplicate_dir"`
+	ActionTimeout   *fileDuration `json:"action_timeout"`
+	ShutdownTimeout *fileDuration `json:"shutdown_timeout"`
+	Retry           *struct {
+		MaxAttempts  *int          `json:"max_attempts"`
+		InitialDelay *fileDuration `json:"initial_delay"`
+		Multiplier   *float64      `json:"multiplier"`
+		MaxDelay     *fileDuration `json:"max_delay"`
+		Jitter       *float64      `json:"jitter"`
+	} `json:"retry"`
+	Debug      *bool        `json:"debug"`
+	LogActions *bool        `json:"log_actions"`
+	LogErrors  *bool        `json:"log_errors"`
+	Actions    []fileAction `json:"actions"`
+	Rules      []fileRule   `json:"rules"`
+	Pipelines  []fileConfig `json:"pipelines"`
+}
+
+/*
+  An action in a config file. Type says which action it is and which of the
+  other fields apply.
+*/
+type fileAction struct {
+	Type string `json:"type"` /* post, run or echo */
+
+	/* post */
+	To           string            `json:"to"`
+	Method       string            `json:"method"`
+	SuccessCodes string            `json:"success_codes"`
+	Mime         string            `json:"mime"`
+	Username     string            `json:"username"`
+	Password     string            `json:"password"`
+	Timeout      fileDuration      `json:"timeout"`
+	Headers      map[string]string `json:"headers"`
+	MimeMap      map[string]string `json:"mime_map"`
+
+	/* post, multipart uploads */
+	Multipart  bool              `json:"multipart"`
+	FieldName  string            `json:"field_name"`
+	UploadName string            `json:"upload_name"`
+	Form       map[string]string `json:"form"`
+
+	/* run */
+	Cmd            string   `json:"cmd"`
+	Args           []string `json:"args"`
+	PostArgs       []string `json:"post_args"`
+	RetryExitCodes []int    `json:"retry_exit_codes"`
+}
+
+/*
+  A routing rule in a config file, see Rule.
+*/
+type fileRule struct {
+	Name       string       `json:"name"`
+	Match      []string     `json:"match"`
+	Extensions []string     `json:"extensions"`
+	MinSize    int64        `json:"min_size"`
+	MaxSize    int64        `json:"max_size"`
+	Mime       []string     `json:"mime"`
+	Actions    []fileAction `json:"actions"`
+	ArchiveDir string       `json:"archive_dir"`
+	ErrorDir   string       `json:"error_dir"`
+}
+
+func (fa *fileAction) action() (Action, error) {
+	switch fa.Type {
+	case "post":
+		if fa.To == "" {
+			return nil, fmt.Errorf("post action needs a \"to\" URL")
+		}
+		pa := &PostAction{
+			To:                fa.To,
+			Method:            fa.Method,
+			Mime:              fa.Mime,
+			BasicAuthUsername: fa.Username,
+			BasicAuthPwd:      fa.Password,
+			Timeout:           time.Duration(fa.Timeout),
+			Headers:           fa.Headers,
+			MimeMap:           fa.MimeMap,
+			Multipart:         fa.Multipart,
+			FieldName:         fa.FieldName,
+			UploadName:        fa.UploadName,
+			Form:              fa.Form,
+		}
+		var err error
+		if pa.Method != "" {
+			if pa.Method, err = ParseMethod(pa.Method); err != nil {
+				return nil, err
+			}
+		}
+		if fa.SuccessCodes != "" {
+			if pa.SuccessCodes, err = ParseStatusCodes(fa.SuccessCodes); err != nil {
+				return nil, err
+			}
+		}
+		if err := pa.Check(); err != nil {
+			return nil, err
+		}
+		return pa, nil
+	case "run":
+		if fa.Cmd == "" {
+			return nil, fmt.Errorf("run action needs a \"cmd\"")
+		}
+		return &RunAction{Cmd: fa.Cmd, Args: fa.Args, PostArgs: fa.PostArgs, RetryExitCodes: fa.RetryExitCodes}, nil
+	case "echo":
+		return &EchoAction{}, nil
+	}
+	return nil, fmt.Errorf("unknown action type %q", fa.Type)
+}
+
+/*
+  Read a config file, YAML (.yaml / .yml), TOML (.toml) or JSON (.json), into
+  a new Config. See LoadConfigInto.
+*/
+func LoadConfig(path string) (*Config, error) {
+	c := &Config{ReportErrors: true}
+	if err := LoadConfigInto(path, c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+/*
+  Read a config file on top of an existing Config, only changing what the file
+  sets. The file's actions (if it has any) replace the config's. The format
+  comes from the file extension.
+*/
+func LoadConfigInto(path string, c *Config) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	fc, err := decodeConfig(filepath.Ext(path), data)
+	if err != nil {
+		return fmt.Errorf("%s: %s", path, err)
+	}
+	if err := fc.apply(c); err != nil {
+		return fmt.Errorf("%s: %s", path, err)
+	}
+	return nil
+}
+
+/*
+  Read the pipelines from a config file for a Manager. Each pipeline starts
+  from base, then the file's top level settings, then the pipeline's own
+  settings, so the top level of the file holds the defaults for every
+  pipeline. A pipeline without a state_dir of its own gets a directory named
+  after it inside the shared one, as pipelines can't share their state.
+  Returns nil if the file doesn't have any pipelines.
+*/
+func LoadPipelines(path string, base *Config) ([]*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	fc, err := decodeConfig(filepath.Ext(path), data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	if len(fc.Pipelines) == 0 {
+		return nil, nil
+	}
+
+	defaults := *base
+	if err := fc.apply(&defaults); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+
+	var configs []*Config
+	seen := make(map[string]bool)
+	for i := range fc.Pipelines {
+		pc := &fc.Pipelines[i]
+		c := defaults
+		if err := pc.apply(&c); err != nil {
+			return nil, fmt.Errorf("%s: pipeline %d: %s", path, i+1, err)
+		}
+		switch {
+		case pc.Pipelines != nil:
+			return nil, fmt.Errorf("%s: pipeline %d: pipelines can't have pipelines", path, i+1)
+		case c.Name == "":
+			return nil, fmt.Errorf("%s: pipeline %d has no name", path, i+1)
+		case seen[c.Name]:
+			return nil, fmt.Errorf("%s: more than one pipeline called %q", path, c.Name)
+		}
+		seen[c.Name] = true
+		if pc.StateDir == nil && c.StateDir != "" {
+			c.StateDir = PipelineStateDir(c.StateDir, c.Name)
+		}
+		configs = append(configs, &c)
+	}
+	return configs, nil
+}
+
+/* Where a pipeline keeps its state in a state directory shared with others */
+func PipelineStateDir(shared, name string) string {
+	return filepath.Join(shared, name)
+}
+
+/*
+  Whatever the format, decode it generically then go via JSON into a
+  fileConfig, so there's only one set of field names and rules (and typos in
+  field names are errors).
+*/
+func decodeConfig(ext string, data []byte) (*fileConfig, error) {
+	var generic interface{}
+	switch strings.ToLower(ext) {
+	case ".yaml", ".yml":
+		if err := yaml.Unmarshal(data, &generic); err != nil {
+			return nil, err
+		}
+	case ".toml":
+		m := map[string]interface{}{}
+		if err := toml.Unmarshal(data, &m); err != nil {
+			return nil, err
+		}
+		generic = m
+	case ".json":
+		if err := json.Unmarshal(data, &generic); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown config file type %q, use .yaml, .yml, .toml or .json", ext)
+	}
+
+	js, err := json.Marshal(generic)
+	if err != nil {
+		return nil, err
+	}
+
+	var fc fileConfig
+	dec := json.NewDecoder(bytes.NewReader(js))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&fc); err != nil {
+		return nil, err
+	}
+	return &fc, nil
+}
+
+func (fc *fileConfig) apply(c *Config) error {
+	setString := func(dst *string, src *string) {
+		if src != nil {
+			*dst = *src
+		}
+	}
+	setBool := func(dst *bool, src *bool) {
+		if src != nil {
+			*dst = *src
+		}
+	}
+	setDuration := func(dst *time.Duration, src *fileDuration) {
+		if src != nil {
+			*dst = time.Duration(*src)
+		}
+	}
+
+	setString(&c.Name, fc.Name)
+	setString(&c.Dir, fc.Dir)
+	setString(&c.ArchiveDir, fc.ArchiveDir)
+	setString(&c.ErrorDir, fc.ErrorDir)
+	setString(&c.StateDir, fc.StateDir)
+	setBool(&c.ProcessExistingFiles, fc.ProcessExisting)
+	setBool(&c.Recursive, fc.Recursive)
+	setString(&c.Backend, fc.Backend)
+	setDuration(&c.PollInterval, fc.PollInterval)
+	setDuration(&c.RescanInterval, fc.RescanInterval)
+	setDuration(&c.RescanAge, fc.RescanAge)
+	if fc.Include != nil {
+		c.Include = fc.Include
+	}
+	if fc.Exclude != nil {
+		c.Exclude = fc.Exclude
+	}
+	if fc.Workers != nil {
+		c.Workers = *fc.Workers
+	}
+	if fc.Paranoia != nil {
+		level, err := ParseParanoia(*fc.Paranoia)
+		if err != nil {
+			return err
+		}
+		c.Paranoia = level
+	}
+	if fc.MarkerSuffixes != nil {
+		c.MarkerSuffixes = fc.MarkerSuffixes
+	}
+	setBool(&c.ArchiveMarkers, fc.ArchiveMarkers)
+	setDuration(&c.QuietPeriod, fc.QuietPeriod)
+	setDuration(&c.ParanoiaWindow, fc.ParanoiaWindow)
+	if fc.ParanoiaSamples != nil {
+		c.ParanoiaSamples = *fc.ParanoiaSamples
+	}
+	setDuration(&c.ParanoiaMaxWait, fc.ParanoiaMaxWait)
+	setBool(&c.Dedup, fc.Dedup)
+	setDuration(&c.DedupRetention, fc.DedupRetention)
+	setString(&c.DuplicateDir, fc.DuplicateDir)
+	setDuration(&c.ActionTimeout, fc.ActionTimeout)
+	setDuration(&c.ShutdownTimeout, fc.ShutdownTimeout)
+	if r := fc.Retry; r != nil {
+		if r.MaxAttempts != nil {
+			c.Retry.MaxAttempts = *r.MaxAttempts
+		}
+		setDuration(&c.Retry.InitialDelay, r.InitialDelay)
+		if r.Multiplier != nil {
+			c.Retry.Multiplier = *r.Multiplier
+		}
+		setDuration(&c.Retry.MaxDelay, r.MaxDelay)
+		if r.Jitter != nil {
+			c.Retry.Jitter = *r.Jitter
+		}
+	}
+	setBool(&c.Debug, fc.Debug)
+	setBool(&c.ReportActions, fc.LogActions)
+	setBool(&c.ReportErrors, fc.LogErrors)
+
+	if fc.Actions != nil {
+		actions, err := fileActions(fc.Actions)
+		if err != nil {
+			return err
+		}
+		c.Actions = actions
+	}
+	if fc.Rules != nil {
+		var rules []Rule
+		for i, fr := range fc.Rules {
+			actions, err := fileActions(fr.Actions)
+			if err != nil {
+				return fmt.Errorf("rule %d: %s", i+1, err)
+			}
+			rules = append(rules, Rule{
+				Name:       fr.Name,
+				Match:      fr.Match,
+				Extensions: fr.Extensions,
+				MinSize:    fr.MinSize,
+				MaxSize:    fr.MaxSize,
+				Mime:       fr.Mime,
+				Actions:    actions,
+				ArchiveDir: fr.ArchiveDir,
+				ErrorDir:   fr.ErrorDir,
+			})
+		}
+		c.Rules = rules
+	}
+	return nil
+}
+
+func fileActions(fas []fileAction) (actions []Action, err error) {
+	for i := range fas {
+		a, err := fas[i].action()
+		if err != nil {
+			return nil, fmt.Errorf("action %d: %s", i+1, err)
+		}
+		actions = append(actions, a)
+	}
+	return actions, nil
+}
+
+/*
+  Check a config makes sense without starting anything: there's a directory
+  and something to do, and the actions, rules and patterns are all valid.
+*/
+func (c *Config) Validate() error {
+	if c.Dir == "" {
+		return fmt.Errorf("no directory to watch")
+	}
+	if len(c.Actions) == 0 && len(c.Rules) == 0 {
+		return fmt.Errorf("no actions")
+	}
+	if err := newWatcher(c).prepareRoutes(); err != nil {
+		return err
+	}
+	if _, err := newFilter(c.Include, c.Exclude); err != nil {
+		return err
+	}
+	switch c.Backend {
+	case "", FsnotifyBackend, PollBackend:
+	default:
+		return fmt.Errorf("unknown backend %q", c.Backend)
+	}
+	if _, ok := paranoiaNames[c.Paranoia.String()]; !ok {
+		return fmt.Errorf("unknown paranoia level %d", int(c.Paranoia))
+	}
+	if c.Workers < 0 {
+		return fmt.Errorf("workers can't be negative")
+	}
+	if c.ParanoiaSamples < 0 {
+		return fmt.Errorf("paranoia samples can't be negative")
+	}
+	if c.Retry.Jitter < 0 || c.Retry.Jitter > 1 {
+		return fmt.Errorf("retry jitter should be between 0 and 1")
+	}
+	return nil
+}
@@ -0,0 +1,341 @@
+package watch
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, dir, name, content string) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(content), 0666); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "springboard")
+	if err != nil {
+		panic(err)
+	}
+	defer func() { os.RemoveAll(tempDir) }()
+
+	files := []string{
+		writeConfig(t, tempDir, "c.yaml", `
+dir: /in
+archive_dir: /arch
+error_dir: /err
+recursive: true
+backend: poll
+poll_interval: 30s
+rescan_interval: 10m
+include: ["*.xml"]
+workers: 8
+paranoia: extra
+action_timeout: 1m
+retry:
+  max_attempts: 5
+  initial_delay: 2s
+  jitter: 0.1
+log_errors: false
+actions:
+  - type: post
+    to: https://example.com/in
+    method: put
+    success_codes: 200-299
+    mime: text/xml
+    username: homer
+    password: s1mps0n
+    timeout: 10s
+    headers:
+      X-Filename: "{{.Name}}"
+    mime_map:
+      po: application/purchase-order
+    multipart: true
+    field_name: upload
+    form:
+      source: springboard
+  - type: run
+    cmd: /bin/cp
+    post_args: [/backup]
+    retry_exit_codes: [75]
+`),
+		writeConfig(t, tempDir, "c.toml", `
+dir = "/in"
+archive_dir = "/arch"
+error_dir = "/err"
+recursive = true
+backend = "poll"
+poll_interval = "30s"
+rescan_interval = "10m"
+include = ["*.xml"]
+workers = 8
+paranoia = "extra"
+action_timeout = "1m"
+log_errors = false
+
+[retry]
+max_attempts = 5
+initial_delay = "2s"
+jitter = 0.1
+
+[[actions]]
+type = "post"
+to = "https://example.com/in"
+method = "put"
+success_codes = "200-299"
+mime = "text/xml"
+username = "homer"
+password = "s1mps0n"
+timeout = "10s"
+headers = { X-Filename = "{{.Name}}" }
+mime_map = { po = "application/purchase-order" }
+multipart = true
+field_name = "upload"
+form = { source = "springboard" }
+
+[[actions]]
+type = "run"
+cmd = "/bin/cp"
+post_args = ["/backup"]
+retry_exit_codes = [75]
+`),
+		writeConfig(t, tempDir, "c.json", `{
+	"dir": "/in", "archive_dir": "/arch", "error_dir": "/err",
+	"recursive": true, "include": ["*.xml"], "workers": 8,
+	"backend": "poll", "poll_interval": "30s", "rescan_interval": "10m",
+	"paranoia": "extra", "action_timeout": "1m", "log_errors": false,
+	"retry": {"max_attempts": 5, "initial_delay": "2s", "jitter": 0.1},
+	"actions": [
+		{"type": "post", "to": "https://example.com/in", "method": "put", "success_codes": "200-299", "mime": "text/xml",
+		 "username": "homer", "password": "s1mps0n", "timeout": "10s",
+		 "headers": {"X-Filename": "{{.Name}}"},
+		 "mime_map": {"po": "application/purchase-order"},
+		 "multipart": true, "field_name": "upload", "form": {"source": "springboard"}},
+		{"type": "run", "cmd": "/bin/cp", "post_args": ["/backup"], "retry_exit_codes": [75]}
+	]
+}`),
+	}
+
+	for _, path := range files {
+		is := func(a, b interface{}, describe string) {
+			if a != b {
+				t.Fatal(path, ": ", describe, " got ", a)
+			}
+		}
+
+		c, err := LoadConfig(path)
+		is(err, nil, "loaded")
+		is(c.Dir, "/in", "dir")
+		is(c.ArchiveDir, "/arch", "archive dir")
+		is(c.ErrorDir, "/err", "error dir")
+		is(c.Recursive, true, "recursive")
+		is(c.Backend, PollBackend, "backend")
+		is(c.PollInterval, 30*time.Second, "poll interval")
+		is(c.RescanInterval, 10*time.Minute, "rescan interval")
+		is(len(c.Include), 1, "include")
+		is(c.Workers, 8, "workers")
+		is(c.Paranoia, ParanoiaLevel(ExtraParanoia), "paranoia")
+		is(c.ActionTimeout, time.Minute, "action timeout")
+		is(c.Retry.MaxAttempts, 5, "retry attempts")
+		is(c.Retry.InitialDelay, 2*time.Second, "retry delay")
+		is(c.Retry.Jitter, 0.1, "retry jitter")
+		is(c.ReportErrors, false, "log errors")
+		is(c.ProcessExistingFiles, false, "unset values left alone")
+		is(len(c.Actions), 2, "actions")
+
+		pa, ok := c.Actions[0].(*PostAction)
+		is(ok, true, "post action")
+		is(pa.To, "https://example.com/in", "post to")
+		is(pa.Method, "PUT", "post method")
+		is(pa.SuccessCodes.String(), "200-299", "post success codes")
+		is(pa.Mime, "text/xml", "post mime")
+		is(pa.BasicAuthUsername, "homer", "post username")
+		is(pa.BasicAuthPwd, "s1mps0n", "post password")
+		is(pa.Timeout, 10*time.Second, "post timeout")
+		is(pa.Headers["X-Filename"], "{{.Name}}", "post headers")
+		is(pa.MimeMap["po"], "application/purchase-order", "post mime map")
+		is(pa.Multipart, true, "post multipart")
+		is(pa.FieldName, "upload", "post field name")
+		is(pa.Form["source"], "springboard", "post form")
+
+		ra, ok := c.Actions[1].(*RunAction)
+		is(ok, true, "run action")
+		is(ra.Cmd, "/bin/cp", "run cmd")
+		is(ra.PostArgs[0], "/backup", "run post args")
+		is(ra.RetryExitCodes[0], 75, "run retry exit codes")
+
+		is(c.Validate(), nil, "valid")
+	}
+}
+
+func TestLoadConfigInto(t *testing.T) {
+	is := makeIs(t)
+	tempDir, err := ioutil.TempDir("", "springboard")
+	if err != nil {
+		panic(err)
+	}
+	defer func() { os.RemoveAll(tempDir) }()
+
+	c := Config{Dir: "/flag", Workers: 3, Actions: []Action{&EchoAction{}}}
+	path := writeConfig(t, tempDir, "c.yml", "workers: 5\nparanoia: marker\nmarker_suffixes: [.fin]\narchive_markers: true\n")
+	is(LoadConfigInto(path, &c), nil, "loaded")
+	is(c.Workers, 5, "file value used")
+	is(c.Paranoia, ParanoiaLevel(MarkerParanoia), "marker paranoia")
+	is(c.MarkerSuffixes[0], ".fin", "marker suffix")
+	is(c.ArchiveMarkers, true, "archive markers")
+	is(c.Dir, "/flag", "value not in the file left alone")
+	is(len(c.Actions), 1, "actions not in the file left alone")
+}
+
+func TestBadConfig(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "springboard")
+	if err != nil {
+		panic(err)
+	}
+	defer func() { os.RemoveAll(tempDir) }()
+
+	for name, content := range map[string]string{
+		"typo.yaml":     "dri: /in\n",
+		"action.yaml":   "actions: [{type: fax}]\n",
+		"noto.yaml":     "actions: [{type: post}]\n",
+		"url.yaml":      "actions: [{type: post, to: 'http://x/{{.Name'}]\n",
+		"header.yaml":   "actions: [{type: post, to: 'http://x', headers: {X-Name: '{{.Name'}}]\n",
+		"urlfield.yaml": "actions: [{type: post, to: 'http://x/{{.Filename}}'}]\n",
+		"field.yaml":    "actions: [{type: post, to: 'http://x', headers: {X-Name: '{{.Filename}}'}}]\n",
+		"form.yaml":     "actions: [{type: post, to: 'http://x', multipart: true, form: {name: '{{.Filename}}'}}]\n",
+		"method.yaml":   "actions: [{type: post, to: 'http://x', method: DELETE}]\n",
+		"codes.yaml":    "actions: [{type: post, to: 'http://x', success_codes: ok}]\n",
+		"duration.yaml": "action_timeout: 30\n",
+		"paranoia.json": `{"paranoia": "lots"}`,
+		"broken.toml":   "dir = \n",
+		"c.ini":         "dir=/in\n",
+	} {
+		if _, err := LoadConfig(writeConfig(t, tempDir, name, content)); err == nil {
+			t.Fatal(name, " loaded")
+		}
+	}
+
+	for describe, c := range map[string]Config{
+		"no dir":      {Actions: []Action{&EchoAction{}}},
+		"no actions":  {Dir: "/in"},
+		"bad backend": {Dir: "/in", Actions: []Action{&EchoAction{}}, Backend: "pigeon"},
+		"bad pattern": {Dir: "/in", Actions: []Action{&EchoAction{}}, Include: []string{"re:("}},
+		"bad action":  {Dir: "/in", Actions: []Action{nil}},
+		"not action":  {Dir: "/in", Actions: []Action{"echo"}},
+	} {
+		if c.Validate() == nil {
+			t.Fatal(describe, " passed validation")
+		}
+	}
+}
+
+func TestLoadPipelines(t *testing.T) {
+	is := makeIs(t)
+	tempDir, err := ioutil.TempDir("", "springboard")
+	if err != nil {
+		panic(err)
+	}
+	defer func() { os.RemoveAll(tempDir) }()
+
+	path := writeConfig(t, tempDir, "c.yaml", `
+workers: 2
+error_dir: /err
+state_dir: /state
+actions:
+  - type: echo
+pipelines:
+  - name: orders
+    dir: /in/orders
+    actions:
+      - type: post
+        to: https://example.com/orders
+  - name: print
+    dir: /in/print
+    state_dir: /print-state
+    workers: 1
+    paranoia: off
+`)
+	base := Config{ReportErrors: true, Paranoia: BasicParanoia}
+	pipelines, err := LoadPipelines(path, &base)
+	is(err, nil, "loaded")
+	is(len(pipelines), 2, "two pipelines")
+
+	orders, print := pipelines[0], pipelines[1]
+	is(orders.Name, "orders", "first name")
+	is(orders.Dir, "/in/orders", "first dir")
+	is(orders.Workers, 2, "default from the top level")
+	is(orders.ErrorDir, "/err", "shared error dir")
+	is(orders.Paranoia, ParanoiaLevel(BasicParanoia), "default from base")
+	is(orders.StateDir, "/state/orders", "own directory in the shared state dir")
+	_, ok := orders.Actions[0].(*PostAction)
+	is(ok, true, "own actions")
+
+	is(print.Name, "print", "second name")
+	is(print.Workers, 1, "overridden")
+	is(print.Paranoia, ParanoiaLevel(NoParanoia), "own paranoia")
+	is(print.StateDir, "/print-state", "own state dir")
+	_, ok = print.Actions[0].(*EchoAction)
+	is(ok, true, "actions from the top level")
+	is(base.Workers, 0, "base left alone")
+
+	none, err := LoadPipelines(writeConfig(t, tempDir, "single.yaml", "dir: /in\n"), &base)
+	is(err, nil, "single loaded")
+	is(len(none), 0, "no pipelines")
+
+	for name, content := range map[string]string{
+		"noname.yaml": "pipelines: [{dir: /a}]\n",
+		"dupe.yaml":   "pipelines: [{name: a, dir: /a}, {name: a, dir: /b}]\n",
+		"nested.yaml": "pipelines: [{name: a, pipelines: [{name: b}]}]\n",
+	} {
+		if _, err := LoadPipelines(writeConfig(t, tempDir, name, content), &base); err == nil {
+			t.Fatal(name, " loaded")
+		}
+	}
+}
+
+func TestLoadRules(t *testing.T) {
+	is := makeIs(t)
+	tempDir, err := ioutil.TempDir("", "springboard")
+	if err != nil {
+		panic(err)
+	}
+	defer func() { os.RemoveAll(tempDir) }()
+
+	c, err := LoadConfig(writeConfig(t, tempDir, "c.yaml", `
+dir: /in
+error_dir: /err
+rules:
+  - name: orders
+    match: ["*.xml"]
+    archive_dir: /orders
+    actions:
+      - type: post
+        to: https://example.com/orders
+  - name: print
+    extensions: [pdf]
+    mime: [application/pdf]
+    max_size: 1000000
+    actions:
+      - type: run
+        cmd: lpr
+  - name: reject
+    min_size: 1
+`))
+	is(err, nil, "loaded")
+	is(len(c.Rules), 3, "rules")
+	is(c.Rules[0].ArchiveDir, "/orders", "rule archive dir")
+	_, ok := c.Rules[0].Actions[0].(*PostAction)
+	is(ok, true, "rule action")
+	is(c.Rules[1].Extensions[0], "pdf", "extensions")
+	is(c.Rules[1].MaxSize, int64(1000000), "max size")
+	is(len(c.Rules[2].Actions), 0, "rule without actions")
+	is(c.Validate(), nil, "rules without default actions are valid")
+
+	if _, err := LoadConfig(writeConfig(t, tempDir, "bad.yaml", "rules: [{actions: [{type: fax}]}]\n")); err == nil {
+		t.Fatal("bad rule action loaded")
+	}
+}
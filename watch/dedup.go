@@ -0,0 +1,237 @@
+package watch
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+/* Name of the file inside Config.StateDir remembering what we've sent */
+const hashesName = "hashes.jsonl"
+
+/* How long we remember what we've sent unless Config.DedupRetention says otherwise */
+const DefaultDedupRetention = 7 * 24 * time.Hour
+
+/* Result.Err for a file with the same content as one we've already sent */
+var errDuplicate = errors.New("duplicate of a file already processed")
+
+/*
+  A file we processed successfully, by the SHA-256 of its content.
+*/
+type hashEntry struct {
+	Hash string    `json:"sha256"`
+	Path string    `json:"path"` /* Where the file was when we processed it */
+	Sent time.Time `json:"sent"`
+}
+
+/*
+  Remembers the content of the files we've processed, for Config.Dedup. Kept
+  in a jsonlStore as the journal is, or just in memory without a
+  Config.StateDir. Entries older than the retention are forgotten.
+*/
+type hashStore struct {
+	retention time.Duration
+	lock      sync.Mutex
+	store     jsonlStore
+	entries   map[string]*hashEntry
+	busy      map[string]chan struct{} /* Hashes of files being processed right now */
+}
+
+func openHashStore(dir string, retention time.Duration) (*hashStore, error) {
+	if retention <= 0 {
+		retention = DefaultDedupRetention
+	}
+	s := &hashStore{
+		retention: retention,
+		entries:   make(map[string]*hashEntry),
+		busy:      make(map[string]chan struct{}),
+		store:     jsonlStore{name: "hash store"},
+	}
+	if dir == "" {
+		return s, nil
+	}
+
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, err
+	}
+	s.store.path = filepath.Join(dir, hashesName)
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	if err := s.compact(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *hashStore) load() error {
+	return s.store.load(func(line []byte) {
+		var e hashEntry
+		if json.Unmarshal(line, &e) != nil || e.Hash == "" {
+			return
+		}
+		s.entries[e.Hash] = &e
+	})
+}
+
+/* Rewrite the file with just the entries we still care about */
+func (s *hashStore) compact() error {
+	var values []interface{}
+	for hash, e := range s.entries {
+		if s.expired(e) {
+			delete(s.entries, hash)
+		} else {
+			values = append(values, e)
+		}
+	}
+	return s.store.rewrite(values)
+}
+
+func (s *hashStore) expired(e *hashEntry) bool {
+	return time.Since(e.Sent) > s.retention
+}
+
+/*
+  Wait until no other file with this content is being processed, then claim
+  it. Without this two copies arriving together could both be sent. Returns
+  false if ctx is done first, otherwise call end when finished.
+*/
+func (s *hashStore) begin(ctx context.Context, hash string) bool {
+	for {
+		s.lock.Lock()
+		wait, ok := s.busy[hash]
+		if !ok {
+			s.busy[hash] = make(chan struct{})
+			s.lock.Unlock()
+			return true
+		}
+		s.lock.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return false
+		case <-wait:
+		}
+	}
+}
+
+func (s *hashStore) end(hash string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if wait, ok := s.busy[hash]; ok {
+		close(wait)
+		delete(s.busy, hash)
+	}
+}
+
+/* The file we processed with this content, if it was recent enough to count */
+func (s *hashStore) get(hash string) (hashEntry, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	e, ok := s.entries[hash]
+	if !ok || s.expired(e) {
+		return hashEntry{}, false
+	}
+	return *e, true
+}
+
+/* Remember that we've processed the file at path, with this content */
+func (s *hashStore) add(hash, path string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	e := &hashEntry{Hash: hash, Path: journalKey(path), Sent: time.Now()}
+	s.entries[hash] = e
+	if err := s.store.append(e); err != nil {
+		return err
+	}
+	if s.store.tooBig(len(s.entries)) {
+		return s.compact()
+	}
+	return nil
+}
+
+func (s *hashStore) close() error {
+	if s == nil {
+		return nil
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.store.close()
+}
+
+/* The SHA-256 of the file's content, in hex */
+func fileHash(path string) (string, error) {
+	sum, err := fileDigest(path, sha256.New())
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(sum), nil
+}
+
+/* The file's content run through h */
+func fileDigest(path string, h hash.Hash) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+/*
+  With Config.Dedup, find out if path has the same content as a file we've
+  already processed. Returns the file's hash, which the caller must pass to
+  w.hashes.end when it's finished with the file, and a result if the actions
+  shouldn't be run: a skip for a duplicate, or because we're stopping.
+*/
+func (w *Watcher) checkDuplicate(path string) (string, *Result) {
+	if w.hashes == nil {
+		return "", nil
+	}
+
+	hash, err := fileHash(path)
+	if err != nil {
+		w.error("Could not check ", path, " for duplicates, carrying on: ", err)
+		return "", nil
+	}
+	if !w.hashes.begin(w.ctx, hash) {
+		return "", Skipped(errInterrupted)
+	}
+
+	if e, ok := w.hashes.get(hash); ok {
+		return hash, Skipped(errDuplicate).Set("sha256", hash).Set("duplicate_of", e.Path)
+	}
+	return hash, nil
+}
+
+/*
+  Get rid of a duplicate: into Config.DuplicateDir if there is one, otherwise
+  delete it.
+*/
+func (w *Watcher) discardDuplicate(path, rel string) {
+	if dir := w.Config.DuplicateDir; dir != "" {
+		w.report_action("Moving duplicate ", path, " to ", dir)
+		if _, err := moveFile(path, dir, rel); err != nil {
+			w.error(err)
+		}
+	} else {
+		w.report_action("Deleting duplicate ", path)
+		if err := os.Remove(path); err != nil {
+			w.error(err)
+		}
+	}
+	w.finishMarker(path, rel, w.Config.DuplicateDir)
+}
@@ -0,0 +1,128 @@
+package watch
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDedup(t *testing.T) {
+	mkTempDir := func() string {
+		s, e := ioutil.TempDir("", "springboard")
+		if e != nil {
+			panic(e)
+		}
+		return s
+	}
+	sep := string(os.PathSeparator)
+
+	tempDir, archDir, dupDir, stateDir, srcDir := mkTempDir(), mkTempDir(), mkTempDir(), mkTempDir(), mkTempDir()
+	for _, d := range []string{tempDir, archDir, dupDir, stateDir, srcDir} {
+		defer os.RemoveAll(d)
+	}
+
+	results := make(chan *Result, 1)
+	cfg := Config{
+		dontBlock:    true,
+		Dir:          tempDir,
+		ArchiveDir:   archDir,
+		StateDir:     stateDir,
+		Dedup:        true,
+		DuplicateDir: dupDir,
+		AfterFileAction: func(file string, result *Result) {
+			results <- result
+		},
+	}
+	run := func() *Watcher {
+		w, err := NewWatcher(&cfg)
+		if err != nil {
+			panic(err)
+		}
+		if err := w.Run(); err != nil {
+			t.Fatal(err)
+		}
+		return w
+	}
+	/* Moved in whole, so we never hash a half written file */
+	drop := func(name, content string) *Result {
+		ioutil.WriteFile(srcDir+sep+name, []byte(content), 0666)
+		os.Rename(srcDir+sep+name, tempDir+sep+name)
+		select {
+		case r := <-results:
+			return r
+		case <-time.After(time.Second):
+			t.Fatal(name, " not processed")
+		}
+		return nil
+	}
+
+	is := makeIs(t)
+	w := run()
+	r := drop("a", "same")
+	is(r.Outcome, SuccessOutcome, "first copy processed")
+	is(r.Meta["sha256"] != "", true, "hash reported")
+	r = drop("b", "same")
+	is(r.Outcome, SkipOutcome, "second copy skipped")
+	is(r.Err, errDuplicate, "as a duplicate")
+	is(r.Meta["duplicate_of"], tempDir+sep+"a", "of the first")
+	is(drop("c", "different").Outcome, SuccessOutcome, "different content processed")
+	makeFileIn(t, "a")(archDir, true, "first archived")
+	makeFileIn(t, "b")(dupDir, true, "duplicate moved to the duplicate dir")
+	w.Shutdown(context.Background())
+
+	/* Remembered after a restart, and deleted without a duplicate dir */
+	cfg.DuplicateDir = ""
+	w = run()
+	defer w.Close()
+	is(drop("d", "same").Err, errDuplicate, "duplicate after a restart")
+	makeFileIn(t, "d")(tempDir, false, "duplicate deleted")
+	makeFileIn(t, "d")(archDir, false, "duplicate not archived")
+}
+
+func TestHashStore(t *testing.T) {
+	is := makeIs(t)
+	stateDir, err := ioutil.TempDir("", "springboard")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(stateDir)
+
+	s, err := openHashStore(stateDir, time.Hour)
+	is(err, nil, "opened")
+	is(s.add("old", "/in/old"), nil, "added")
+	is(s.add("new", "/in/new"), nil, "added")
+	s.entries["old"].Sent = time.Now().Add(-2 * time.Hour)
+	_, ok := s.get("old")
+	is(ok, false, "expired entry forgotten")
+	e, ok := s.get("new")
+	is(ok && e.Path == "/in/new", true, "recent entry remembered")
+
+	/* Expired entries are dropped from the file too */
+	s.compact()
+	s.close()
+	s, err = openHashStore(stateDir, time.Hour)
+	is(err, nil, "reopened")
+	is(len(s.entries), 1, "only the recent entry kept")
+	defer s.close()
+
+	/* A second file with the same content waits for the first */
+	ctx := context.Background()
+	is(s.begin(ctx, "x"), true, "first begins")
+	begun := make(chan bool)
+	go func() { begun <- s.begin(ctx, "x") }()
+	select {
+	case <-begun:
+		t.Fatal("second didn't wait")
+	case <-time.After(50 * time.Millisecond):
+	}
+	s.end("x")
+	is(<-begun, true, "second begins once the first ends")
+	s.end("x")
+
+	cancelled, cancel := context.WithCancel(ctx)
+	s.begin(ctx, "y")
+	cancel()
+	is(s.begin(cancelled, "y"), false, "waiting can be cancelled")
+}
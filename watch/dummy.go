@@ -1,14 +1,19 @@
 package watch
 
+import (
+	"context"
+	"errors"
+)
+
 type DummyAction struct {
 	LastFile   string
 	FailPlease bool
 }
 
-func (a *DummyAction) Process(w *Watcher, file string) bool {
+func (a *DummyAction) Process(ctx context.Context, w *Watcher, file string) *Result {
 	a.LastFile = file
 	if a.FailPlease {
-		return false
+		return Failed(errors.New("failing as asked"))
 	}
-	return true
+	return Succeeded()
 }
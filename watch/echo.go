@@ -1,11 +1,15 @@
 package watch
 
-import "fmt"
+import (
+	"context"
+	"fmt"
+)
 
 type EchoAction struct {
 }
-func (a *EchoAction) Process( w *Watcher, file string) (bool){
+
+func (a *EchoAction) Process(ctx context.Context, w *Watcher, file string) *Result {
 	w.report_action("Echoing ", file)
 	fmt.Println(file)
-	return true
+	return Succeeded()
 }
@@ -0,0 +1,219 @@
+package watch
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+)
+
+/*
+  A file being sent, for PostAction's templates to fill in. The hashes are
+  only worked out if a template uses them, then kept for the file's other
+  templates.
+*/
+type fileDetails struct {
+	path    string
+	rel     string /* Where the file is relative to the watched directory */
+	size    int64
+	modTime time.Time
+	sha256  string
+	md5     string
+}
+
+func newFileDetails(file, rel string) (*fileDetails, error) {
+	fi, err := os.Stat(file)
+	if err != nil {
+		return nil, err
+	}
+	return &fileDetails{path: file, rel: rel, size: fi.Size(), modTime: fi.ModTime()}, nil
+}
+
+/*
+  A made up file to try templates out on. The hashes are already filled in,
+  so nothing goes looking for it on disk.
+*/
+func sampleFileDetails() *fileDetails {
+	return &fileDetails{
+		path:    filepath.FromSlash("/in/acme/order.xml"),
+		rel:     filepath.FromSlash("acme/order.xml"),
+		size:    8,
+		modTime: time.Date(2020, 2, 3, 4, 5, 6, 0, time.UTC),
+		sha256:  "sample",
+		md5:     "sample",
+	}
+}
+
+/* How a templateFile escapes its values, for where they're going */
+type escaping int
+
+const (
+	noEscaping    escaping = iota /* Headers, form fields and the upload name */
+	pathEscaping                  /* The path of PostAction.To, before the ? */
+	queryEscaping                 /* The query of PostAction.To, after the ? */
+)
+
+/*
+  What PostAction's templates (To, Headers, UploadName and Form) can use,
+  with Go template syntax, eg "{{.Name}}" or "sha-256={{.SHA256}}". They all
+  get the same details, in To escaped for wherever they are in the URL.
+*/
+type templateFile struct {
+	file     *fileDetails
+	escaping escaping
+}
+
+func (f *templateFile) escape(s string) string {
+	switch f.escaping {
+	case pathEscaping:
+		return url.PathEscape(s)
+	case queryEscaping:
+		return url.QueryEscape(s)
+	}
+	return s
+}
+
+/* Escape a /-separated path, in a URL's path each part separately so the /s stay */
+func (f *templateFile) escapeSlashed(s string) string {
+	if f.escaping != pathEscaping {
+		return f.escape(s)
+	}
+	parts := strings.Split(s, "/")
+	for i := range parts {
+		parts[i] = url.PathEscape(parts[i])
+	}
+	return strings.Join(parts, "/")
+}
+
+/* The file's full path, with /s in URLs */
+func (f *templateFile) Path() string {
+	if f.escaping == noEscaping {
+		return f.file.path
+	}
+	return f.escapeSlashed(filepath.ToSlash(f.file.path))
+}
+
+/* The file's name, eg order.xml */
+func (f *templateFile) Name() string {
+	return f.escape(filepath.Base(f.file.path))
+}
+
+/* The file's extension without the dot, eg xml */
+func (f *templateFile) Ext() string {
+	return f.escape(strings.TrimPrefix(filepath.Ext(f.file.path), "."))
+}
+
+/* The file's name without its extension, eg order */
+func (f *templateFile) Stem() string {
+	name := filepath.Base(f.file.path)
+	return f.escape(strings.TrimSuffix(name, filepath.Ext(name)))
+}
+
+/*
+  The directory the file is in relative to the watched directory, eg
+  acme/orders in recursive mode, empty for files at the top.
+*/
+func (f *templateFile) Dir() string {
+	dir := filepath.ToSlash(filepath.Dir(f.file.rel))
+	if dir == "." {
+		return ""
+	}
+	return f.escapeSlashed(dir)
+}
+
+/* In bytes */
+func (f *templateFile) Size() int64 {
+	return f.file.size
+}
+
+/* When the file was last modified, as RFC 3339 in UTC, eg 2020-02-03T04:05:06Z */
+func (f *templateFile) ModTime() string {
+	return f.escape(f.file.modTime.UTC().Format(time.RFC3339))
+}
+
+/* The SHA-256 of the file's content, in hex */
+func (f *templateFile) SHA256() (string, error) {
+	if f.file.sha256 == "" {
+		hash, err := fileHash(f.file.path)
+		if err != nil {
+			return "", err
+		}
+		f.file.sha256 = hash
+	}
+	return f.escape(f.file.sha256), nil
+}
+
+/* The MD5 of the file's content, base64 encoded as Content-MD5 wants it */
+func (f *templateFile) MD5() (string, error) {
+	if f.file.md5 == "" {
+		sum, err := fileDigest(f.file.path, md5.New())
+		if err != nil {
+			return "", err
+		}
+		f.file.md5 = base64.StdEncoding.EncodeToString(sum)
+	}
+	return f.escape(f.file.md5), nil
+}
+
+/*
+  Parse a template using the file's details (a header value, form field and
+  so on), trying it on a sample file so mistakes, including fields which
+  don't exist, are found before there are any files. kind and key say what
+  it is, for errors.
+*/
+func parseTemplate(kind, key, value string) (*template.Template, error) {
+	tmpl, err := template.New(key).Option("missingkey=error").Parse(value)
+	if err == nil {
+		err = tmpl.Execute(ioutil.Discard, &templateFile{file: sampleFileDetails()})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s %s: %s", kind, key, err)
+	}
+	return tmpl, nil
+}
+
+/* parseTemplate for each of values, by name */
+func parseTemplates(kind string, values map[string]string) (map[string]*template.Template, error) {
+	parsed := make(map[string]*template.Template, len(values))
+	for key, value := range values {
+		if strings.TrimSpace(key) == "" {
+			return nil, fmt.Errorf("%s with no name", kind)
+		}
+		tmpl, err := parseTemplate(kind, key, value)
+		if err != nil {
+			return nil, err
+		}
+		parsed[key] = tmpl
+	}
+	return parsed, nil
+}
+
+/* Fill in a template for file */
+func fillTemplate(kind string, tmpl *template.Template, file *fileDetails) (string, error) {
+	var value strings.Builder
+	if err := tmpl.Execute(&value, &templateFile{file: file}); err != nil {
+		return "", fmt.Errorf("%s %s: %s", kind, tmpl.Name(), err)
+	}
+	return value.String(), nil
+}
+
+/*
+  Fill in parsed templates for file.
+*/
+func fillTemplates(kind string, parsed map[string]*template.Template, file *fileDetails) (map[string]string, error) {
+	filled := make(map[string]string, len(parsed))
+	for key, tmpl := range parsed {
+		value, err := fillTemplate(kind, tmpl, file)
+		if err != nil {
+			return nil, err
+		}
+		filled[key] = value
+	}
+	return filled, nil
+}
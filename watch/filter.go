@@ -0,0 +1,98 @@
+package watch
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+/* Prefix marking a filter pattern as a regular expression rather than a glob */
+const regexPrefix = "re:"
+
+/*
+  A single include / exclude pattern. Globs without a slash are matched
+  against the filename, globs with one against the path relative to the
+  watched directory. Regexes (re:...) are always matched against the relative
+  path, which uses forward slashes on every platform.
+*/
+type pattern struct {
+	glob string
+	re   *regexp.Regexp
+}
+
+func compilePattern(p string) (*pattern, error) {
+	if strings.HasPrefix(p, regexPrefix) {
+		re, err := regexp.Compile(strings.TrimPrefix(p, regexPrefix))
+		if err != nil {
+			return nil, fmt.Errorf("bad regex pattern %q: %s", p, err)
+		}
+		return &pattern{re: re}, nil
+	}
+
+	if _, err := path.Match(p, ""); err != nil {
+		return nil, fmt.Errorf("bad glob pattern %q: %s", p, err)
+	}
+	return &pattern{glob: p}, nil
+}
+
+func (p *pattern) match(rel string) bool {
+	rel = filepath.ToSlash(rel)
+	if p.re != nil {
+		return p.re.MatchString(rel)
+	}
+
+	name := rel
+	if !strings.Contains(p.glob, "/") {
+		name = path.Base(rel)
+	}
+	ok, _ := path.Match(p.glob, name)
+	return ok
+}
+
+/*
+  Decides which files we're interested in from Config.Include & Config.Exclude
+*/
+type filter struct {
+	include []*pattern
+	exclude []*pattern
+}
+
+func newFilter(include, exclude []string) (*filter, error) {
+	var f filter
+	for _, list := range []struct {
+		src []string
+		dst *[]*pattern
+	}{{include, &f.include}, {exclude, &f.exclude}} {
+		for _, p := range list.src {
+			cp, err := compilePattern(p)
+			if err != nil {
+				return nil, err
+			}
+			*list.dst = append(*list.dst, cp)
+		}
+	}
+	return &f, nil
+}
+
+/*
+  Is the file at rel (relative to the watched directory) one we want? If
+  there are include patterns it has to match one of them, and it must not match
+  any exclude pattern.
+*/
+func (f *filter) wanted(rel string) bool {
+	if len(f.include) > 0 && !matchAny(f.include, rel) {
+		return false
+	}
+	return !matchAny(f.exclude, rel)
+}
+
+func matchAny(patterns []*pattern, rel string) bool {
+	for _, p := range patterns {
+		if p.match(rel) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,113 @@
+package watch
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestFilterWanted(t *testing.T) {
+	is := makeIs(t)
+
+	f, err := newFilter(nil, nil)
+	is(err, nil, "empty filter compiles")
+	is(f.wanted("anything"), true, "empty filter wants everything")
+
+	f, err = newFilter([]string{"*.xml", "re:^orders/.*\\.csv$"}, []string{"*~", "*.tmp", "*.part"})
+	is(err, nil, "filter compiles")
+	is(f.wanted("foo.xml"), true, "included by glob")
+	is(f.wanted("acme/foo.xml"), true, "glob without a slash matches the filename in a subdirectory")
+	is(f.wanted("orders/foo.csv"), true, "included by regex")
+	is(f.wanted("foo.csv"), false, "regex matches the relative path")
+	is(f.wanted("foo.txt"), false, "not included")
+	is(f.wanted("foo.xml.tmp"), false, "not included & excluded")
+
+	f, err = newFilter(nil, []string{"*~", "*.tmp", "acme/*"})
+	is(err, nil, "exclude only filter compiles")
+	is(f.wanted("foo.txt"), true, "not excluded")
+	is(f.wanted("foo.txt~"), false, "editor backup excluded")
+	is(f.wanted("acme/foo.txt"), false, "glob with a slash matches the relative path")
+	is(f.wanted("other/foo.txt"), true, "other subdirectory not excluded")
+}
+
+func TestFilterBadPatterns(t *testing.T) {
+	if _, err := newFilter([]string{"[oops"}, nil); err == nil {
+		t.Fatal("bad glob accepted")
+	}
+	if _, err := newFilter(nil, []string{"re:(oops"}); err == nil {
+		t.Fatal("bad regex accepted")
+	}
+
+	tempDir, err := ioutil.TempDir("", "springboard")
+	if err != nil {
+		panic(err)
+	}
+	defer func() { os.Remove(tempDir) }()
+
+	cfg := Config{
+		dontBlock: true,
+		Dir:       tempDir,
+		Exclude:   []string{"re:(oops"},
+	}
+	if err := Watch(&cfg); err == nil {
+		t.Fatal("Watch accepted a bad pattern")
+	}
+}
+
+func TestFilterEvents(t *testing.T) {
+	mkTempDir := func() string {
+		s, e := ioutil.TempDir("", "springboard")
+		if e != nil {
+			panic(e)
+		}
+		return s
+	}
+
+	tempDir := mkTempDir()
+	archDir := mkTempDir()
+
+	defer func() { os.RemoveAll(tempDir) }()
+	defer func() { os.RemoveAll(archDir) }()
+
+	for _, v := range []string{"old.xml", "old.xml.part"} {
+		_, err := os.Create(tempDir + string(os.PathSeparator) + v)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	wait := make(chan string)
+	cfg := Config{
+		dontBlock: true,
+		Dir:       tempDir,
+		Debug:     true,
+		AfterFileAction: func(file string, result *Result) {
+			wait <- file
+		},
+		ArchiveDir:           archDir,
+		ProcessExistingFiles: true,
+		Include:              []string{"*.xml"},
+		Exclude:              []string{"re:^ignored"},
+	}
+
+	Watch(&cfg)
+	<-wait
+
+	for _, v := range []string{"new.tmp", "ignored.xml", "new.xml"} {
+		_, err := os.Create(tempDir + string(os.PathSeparator) + v)
+		if err != nil {
+			panic(err)
+		}
+	}
+	<-wait
+
+	for _, v := range []string{"old.xml", "new.xml"} {
+		fileIn := makeFileIn(t, v)
+		fileIn(archDir, true, v+" IS in arch dir")
+	}
+	for _, v := range []string{"old.xml.part", "new.tmp", "ignored.xml"} {
+		fileIn := makeFileIn(t, v)
+		fileIn(archDir, false, v+" is NOT in arch dir")
+		fileIn(tempDir, true, v+" IS in source dir")
+	}
+}
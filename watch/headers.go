@@ -0,0 +1,59 @@
+package watch
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"text/template"
+)
+
+func parseHeaders(headers map[string]string) (map[string]*template.Template, error) {
+	return parseTemplates("header", headers)
+}
+
+/*
+  The headers for sending file, with their templates filled in.
+*/
+func fileHeaders(headers map[string]*template.Template, file *fileDetails) (http.Header, error) {
+	filled, err := fillTemplates("header", headers, file)
+	if err != nil {
+		return nil, err
+	}
+	h := make(http.Header)
+	for key, value := range filled {
+		h.Set(key, value)
+	}
+	return h, nil
+}
+
+/*
+  Split a KEY=VAL form field from the command line. The value's template is
+  checked along with the rest by PostAction.Check.
+*/
+func ParseFormField(field string) (key, value string, err error) {
+	i := strings.Index(field, "=")
+	if i <= 0 {
+		return "", "", fmt.Errorf("bad form field %q, use KEY=VAL", field)
+	}
+	key, value = strings.TrimSpace(field[:i]), field[i+1:]
+	if key == "" {
+		return "", "", fmt.Errorf("form field with no name")
+	}
+	return key, value, nil
+}
+
+/*
+  Split a KEY:VAL header from the command line. The value's template is
+  checked along with the rest by PostAction.Check.
+*/
+func ParseHeader(header string) (key, value string, err error) {
+	i := strings.Index(header, ":")
+	if i <= 0 {
+		return "", "", fmt.Errorf("bad header %q, use KEY:VAL", header)
+	}
+	key, value = strings.TrimSpace(header[:i]), strings.TrimSpace(header[i+1:])
+	if key == "" {
+		return "", "", fmt.Errorf("header with no name")
+	}
+	return key, value, nil
+}
@@ -0,0 +1,205 @@
+package watch
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/theckman/go-flock"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+/* Name of the journal file inside Config.StateDir */
+const journalName = "journal.jsonl"
+
+/* Name of the file we flock(2) so only one of us uses a Config.StateDir at once */
+const stateLockName = "lock"
+
+/* States of a file in the journal */
+const (
+	PendingState = "pending" /* Seen and not finished with, eg waiting for a retry */
+	FailedState  = "failed"  /* Gave up, usually now sitting in the error dir */
+	doneState    = "done"    /* Finished with, only ever in the file to forget an entry */
+)
+
+/*
+  What the journal knows about a file.
+*/
+type JournalEntry struct {
+	Path        string    `json:"path"`                   /* Where the file is, absolute */
+	State       string    `json:"state"`                  /* PendingState or FailedState */
+	Attempts    int       `json:"attempts"`               /* How many times we've run the actions on it */
+	NextAttempt time.Time `json:"next_attempt,omitempty"` /* When a pending file should next be tried */
+	LastError   string    `json:"last_error,omitempty"`   /* Why the last attempt failed */
+	Updated     time.Time `json:"updated"`
+}
+
+/*
+  Keeps track of the files we're working on and the ones we've given up on, on
+  disk, so a restart can pick up where we left off. Every change is appended to
+  a jsonlStore which is compacted when it's loaded and whenever it gets much
+  bigger than what it describes. A nil journal does nothing, which is
+  what you get without a Config.StateDir. The state directory is locked
+  while the journal is open, so a second watcher (or a redrive) can't use it
+  at the same time and compact the files from under us.
+*/
+type journal struct {
+	lock    sync.Mutex
+	dirLock *flock.Flock
+	store   jsonlStore
+	entries map[string]*JournalEntry
+}
+
+func openJournal(dir string) (*journal, error) {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, err
+	}
+
+	dirLock := flock.NewFlock(filepath.Join(dir, stateLockName))
+	locked, err := dirLock.TryLock()
+	if err != nil {
+		return nil, err
+	}
+	if !locked {
+		return nil, fmt.Errorf("state directory %s is in use by another springboard", dir)
+	}
+
+	j := &journal{
+		dirLock: dirLock,
+		store:   jsonlStore{path: filepath.Join(dir, journalName), name: "journal"},
+		entries: make(map[string]*JournalEntry),
+	}
+
+	if err := j.load(); err != nil {
+		dirLock.Unlock()
+		return nil, err
+	}
+	if err := j.compact(); err != nil {
+		dirLock.Unlock()
+		return nil, err
+	}
+	return j, nil
+}
+
+/* Replay the file, the last line for any path wins */
+func (j *journal) load() error {
+	return j.store.load(func(line []byte) {
+		var e JournalEntry
+		if json.Unmarshal(line, &e) != nil || e.Path == "" {
+			return
+		}
+		if e.State == doneState {
+			delete(j.entries, e.Path)
+		} else {
+			j.entries[e.Path] = &e
+		}
+	})
+}
+
+/* Rewrite the file with just the current entries */
+func (j *journal) compact() error {
+	var values []interface{}
+	for _, e := range j.sorted() {
+		values = append(values, e)
+	}
+	return j.store.rewrite(values)
+}
+
+func (j *journal) write(e *JournalEntry) error {
+	e.Updated = time.Now()
+	if err := j.store.append(e); err != nil {
+		return err
+	}
+	if j.store.tooBig(len(j.entries)) {
+		return j.compact()
+	}
+	return nil
+}
+
+func (j *journal) sorted() (entries []*JournalEntry) {
+	for _, e := range j.entries {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(a, b int) bool { return entries[a].Path < entries[b].Path })
+	return
+}
+
+func journalKey(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return filepath.Clean(path)
+}
+
+/* What we know about path, if anything */
+func (j *journal) get(path string) (JournalEntry, bool) {
+	if j == nil {
+		return JournalEntry{}, false
+	}
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	e, ok := j.entries[journalKey(path)]
+	if !ok {
+		return JournalEntry{}, false
+	}
+	return *e, true
+}
+
+/* All the entries in a given state */
+func (j *journal) list(state string) (entries []JournalEntry) {
+	if j == nil {
+		return nil
+	}
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	for _, e := range j.sorted() {
+		if e.State == state {
+			entries = append(entries, *e)
+		}
+	}
+	return
+}
+
+/* Record the state of a file */
+func (j *journal) put(e JournalEntry) error {
+	if j == nil {
+		return nil
+	}
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	e.Path = journalKey(e.Path)
+	j.entries[e.Path] = &e
+	return j.write(&e)
+}
+
+/* Forget about a file */
+func (j *journal) remove(path string) error {
+	if j == nil {
+		return nil
+	}
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	key := journalKey(path)
+	if _, ok := j.entries[key]; !ok {
+		return nil
+	}
+	delete(j.entries, key)
+	return j.write(&JournalEntry{Path: key, State: doneState})
+}
+
+func (j *journal) close() error {
+	if j == nil {
+		return nil
+	}
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	j.dirLock.Unlock()
+	return j.store.close()
+}
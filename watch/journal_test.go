@@ -0,0 +1,215 @@
+package watch
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestJournal(t *testing.T) {
+	is := makeIs(t)
+	stateDir, err := ioutil.TempDir("", "springboard")
+	if err != nil {
+		panic(err)
+	}
+	defer func() { os.RemoveAll(stateDir) }()
+
+	j, err := openJournal(stateDir)
+	is(err, nil, "opened journal")
+
+	next := time.Now().Add(time.Hour).Round(time.Second)
+	is(j.put(JournalEntry{Path: "/x/a", State: PendingState, Attempts: 2, NextAttempt: next}), nil, "put a")
+	is(j.put(JournalEntry{Path: "/x/b", State: PendingState}), nil, "put b")
+	is(j.put(JournalEntry{Path: "/x/c", State: FailedState, Attempts: 5, LastError: "boom"}), nil, "put c")
+	is(j.remove("/x/b"), nil, "remove b")
+	j.close()
+
+	/* Simulate a crash part way through writing a line */
+	f, err := os.OpenFile(filepath.Join(stateDir, journalName), os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		panic(err)
+	}
+	f.Write([]byte(`{"path":"/x/d","sta`))
+	f.Close()
+
+	j, err = openJournal(stateDir)
+	is(err, nil, "reopened journal")
+	defer j.close()
+
+	e, ok := j.get("/x/a")
+	is(ok, true, "a survived")
+	is(e.Attempts, 2, "a attempts")
+	is(e.NextAttempt.Equal(next), true, "a next attempt")
+	_, ok = j.get("/x/b")
+	is(ok, false, "b stays removed")
+	_, ok = j.get("/x/d")
+	is(ok, false, "partial line ignored")
+
+	failed := j.list(FailedState)
+	is(len(failed), 1, "one failed file")
+	is(failed[0].LastError, "boom", "error kept")
+	is(len(j.list(PendingState)), 1, "one pending file")
+
+	var nilJournal *journal
+	is(nilJournal.put(JournalEntry{Path: "/x"}), nil, "nil journal ignores puts")
+	_, ok = nilJournal.get("/x")
+	is(ok, false, "nil journal knows nothing")
+}
+
+func TestJournalResume(t *testing.T) {
+	mkTempDir := func() string {
+		s, e := ioutil.TempDir("", "springboard")
+		if e != nil {
+			panic(e)
+		}
+		return s
+	}
+
+	tempDir := mkTempDir()
+	errDir := mkTempDir()
+	stateDir := mkTempDir()
+	defer func() { os.RemoveAll(tempDir) }()
+	defer func() { os.RemoveAll(errDir) }()
+	defer func() { os.RemoveAll(stateDir) }()
+
+	/* Left over from last time: foo had failed once, bar was never started */
+	j, err := openJournal(stateDir)
+	if err != nil {
+		panic(err)
+	}
+	sep := string(os.PathSeparator)
+	j.put(JournalEntry{Path: tempDir + sep + "foo", State: PendingState, Attempts: 2, LastError: "down"})
+	j.put(JournalEntry{Path: tempDir + sep + "bar", State: PendingState})
+	j.put(JournalEntry{Path: tempDir + sep + "gone", State: PendingState})
+	j.close()
+	for _, v := range []string{"foo", "bar", "untracked"} {
+		if _, err := os.Create(tempDir + sep + v); err != nil {
+			panic(err)
+		}
+	}
+
+	action := flakyAction{failures: 100}
+	wait := make(chan *Result)
+	cfg := Config{
+		dontBlock: true,
+		Dir:       tempDir,
+		Debug:     true,
+		Actions:   []Action{&action},
+		AfterFileAction: func(file string, result *Result) {
+			wait <- result
+		},
+		ErrorDir: errDir,
+		StateDir: stateDir,
+		Workers:  1,
+		Retry: RetryPolicy{
+			MaxAttempts:  3,
+			InitialDelay: 10 * time.Millisecond,
+		},
+	}
+
+	w, err := NewWatcher(&cfg)
+	if err != nil {
+		panic(err)
+	}
+	w.Run()
+
+	is := makeIs(t)
+	for i := 0; i < 2; i++ {
+		is((<-wait).Attempts, 3, "attempts include previous ones")
+	}
+	is(action.count(), 4, "foo carried on from its previous attempts, bar had all three")
+
+	makeFileIn(t, "untracked")(tempDir, true, "untracked file not processed without --process-existing")
+	for _, v := range []string{"foo", "bar"} {
+		makeFileIn(t, v)(errDir, true, v+" in the error dir")
+		e, ok := w.journal.get(errDir + sep + v)
+		is(ok, true, v+" recorded in the error dir")
+		is(e.State, FailedState, v+" recorded as failed")
+		is(e.Attempts, 3, v+" attempts recorded")
+		is(e.LastError, "not yet", v+" error recorded")
+		_, ok = w.journal.get(tempDir + sep + v)
+		is(ok, false, v+" no longer pending")
+	}
+	_, ok := w.journal.get(tempDir + sep + "gone")
+	is(ok, false, "missing file forgotten")
+}
+
+func TestJournalRetry(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "springboard")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tempDir)
+	sep := string(os.PathSeparator)
+
+	action := firstTimeAction{tried: make(map[string]bool), calls: make(chan string, 10)}
+	wait := make(chan *Result)
+	cfg := Config{
+		dontBlock: true,
+		Dir:       tempDir,
+		StateDir:  tempDir + sep + ".state",
+		Actions:   []Action{&action},
+		AfterFileAction: func(file string, result *Result) {
+			wait <- result
+		},
+		Retry: RetryPolicy{
+			MaxAttempts:  2,
+			InitialDelay: 300 * time.Millisecond,
+		},
+	}
+	w, err := NewWatcher(&cfg)
+	if err != nil {
+		panic(err)
+	}
+	w.Run()
+	defer w.Close()
+
+	is := makeIs(t)
+	tfn := tempDir + sep + "foo"
+	ioutil.WriteFile(tfn, []byte("foo"), 0666)
+	<-action.calls
+
+	/* The journal is written once the attempt is over */
+	var e JournalEntry
+	for start := time.Now(); e.Attempts == 0 && time.Since(start) < time.Second; {
+		time.Sleep(10 * time.Millisecond)
+		e, _ = w.journal.get(tfn)
+	}
+	is(e.State, PendingState, "waiting to be retried")
+	is(e.Attempts, 1, "first attempt recorded")
+	is(e.NextAttempt.After(time.Now()), true, "next attempt recorded")
+	is(e.LastError, "first time", "error recorded")
+
+	<-action.calls
+	is((<-wait).Attempts, 2, "worked on the second attempt")
+	_, ok := w.journal.get(tfn)
+	is(ok, false, "forgotten once it's worked")
+}
+
+func TestCloseReleasesState(t *testing.T) {
+	is := makeIs(t)
+	tempDir, err := ioutil.TempDir("", "springboard")
+	if err != nil {
+		panic(err)
+	}
+	defer func() { os.RemoveAll(tempDir) }()
+
+	cfg := Config{
+		dontBlock: true,
+		Dir:       tempDir,
+		StateDir:  filepath.Join(tempDir, ".state"),
+		Dedup:     true,
+		Actions:   []Action{&EchoAction{}},
+	}
+	for i := 0; i < 2; i++ {
+		w, err := NewWatcher(&cfg)
+		if err != nil {
+			panic(err)
+		}
+		is(w.Run(), nil, "state dir free")
+		w.Close()
+		is(w.journal.store.file == nil && w.hashes.store.file == nil, true, "state closed")
+	}
+}
@@ -0,0 +1,122 @@
+package watch
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+/* The longest line we'll read back from a jsonlStore */
+const maxJSONLLine = 1024 * 1024
+
+/*
+  A JSON lines file which changes are appended to, rewritten now and then
+  with just what it still needs to say. The journal and the hash store both
+  keep their state in one. A store without a path keeps nothing. The owner
+  does the locking.
+*/
+type jsonlStore struct {
+	path  string
+	name  string /* What it is, for errors */
+	file  *os.File
+	lines int /* Lines in the file since it was last rewritten */
+}
+
+/*
+  Read the file back, passing each line to each in order. A missing file is
+  an empty one.
+*/
+func (s *jsonlStore) load(each func(line []byte)) error {
+	if s.path == "" {
+		return nil
+	}
+	f, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), maxJSONLLine)
+	for scanner.Scan() {
+		/* A crash can leave a partial last line, which we can live without */
+		each(scanner.Bytes())
+	}
+	return scanner.Err()
+}
+
+/* Add v to the end of the file */
+func (s *jsonlStore) append(v interface{}) error {
+	if s.path == "" {
+		return nil
+	}
+	if s.file == nil {
+		return fmt.Errorf("%s is closed", s.name)
+	}
+	line, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if _, err := s.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	s.lines++
+	return nil
+}
+
+/* Has the file got much bigger than the entries it describes? */
+func (s *jsonlStore) tooBig(entries int) bool {
+	return s.lines > 1000 && s.lines > 2*entries
+}
+
+/*
+  Replace the file with one line for each of values, safely: they're written
+  to a new file which is then renamed over the old one.
+*/
+func (s *jsonlStore) rewrite(values []interface{}) error {
+	if s.path == "" {
+		return nil
+	}
+	tmp := s.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(f)
+	for _, v := range values {
+		if err := enc.Encode(v); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	f.Close()
+
+	if err := os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+
+	if s.file != nil {
+		s.file.Close()
+	}
+	s.file, err = os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND, 0666)
+	s.lines = len(values)
+	return err
+}
+
+func (s *jsonlStore) close() error {
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
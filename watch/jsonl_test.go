@@ -0,0 +1,45 @@
+package watch
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestJSONLStore(t *testing.T) {
+	is := makeIs(t)
+	tempDir, err := ioutil.TempDir("", "springboard")
+	if err != nil {
+		panic(err)
+	}
+	defer func() { os.RemoveAll(tempDir) }()
+
+	s := jsonlStore{path: filepath.Join(tempDir, "s.jsonl"), name: "test store"}
+	var lines []string
+	read := func(line []byte) { lines = append(lines, string(line)) }
+	is(s.load(read), nil, "missing file is empty")
+	is(len(lines), 0, "nothing read")
+
+	long := strings.Repeat("x", 100*1024)
+	is(s.rewrite([]interface{}{"a"}), nil, "rewritten")
+	is(s.append(long), nil, "appended a long line")
+	is(s.lines, 2, "lines counted")
+	is(s.tooBig(1), false, "small files aren't compacted")
+	is(s.close(), nil, "closed")
+	is(s.append("b") != nil, true, "closed store can't be appended to")
+
+	/* as if we crashed part way through a line */
+	f, _ := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND, 0666)
+	f.WriteString(`"partial`)
+	f.Close()
+
+	is(s.load(read), nil, "loaded")
+	is(len(lines), 3, "every line read")
+	is(lines[0], `"a"`, "first line")
+	is(len(lines[1]), len(long)+2, "long line read")
+
+	memory := jsonlStore{name: "memory"}
+	is(memory.append("a"), nil, "store without a path keeps nothing")
+}
@@ -0,0 +1,356 @@
+package watch
+
+import (
+	"context"
+	"fmt"
+	"gopkg.in/fsnotify.v1"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+/* How many events can wait for a busy pipeline before the others are held up */
+const pipelineEventBuffer = 256
+
+/*
+  Runs several watchers ("pipelines") in one process. Each pipeline has its
+  own Config, so its own directory, actions, archive & error directories,
+  paranoia and so on, but they share one logger and (unless they use
+  PollBackend, which each pipeline does for itself) one fsnotify watcher.
+  Pipelines are known by Config.Name and can be started and stopped
+  independently.
+*/
+type Manager struct {
+	Logger *log.Logger /* Used by any pipeline without its own Config.Logger */
+
+	fswatch   Backend
+	lock      sync.Mutex
+	configs   map[string]*Config
+	names     []string /* Pipeline names, in the order they were added */
+	running   map[string]*pipeline
+	stopping  chan struct{}
+	finished  chan struct{}
+	stopOnce  sync.Once
+	closeOnce sync.Once
+}
+
+/* A running pipeline: its watcher and the events we pass on to it, if it shares ours */
+type pipeline struct {
+	watcher *Watcher
+	events  chan fsnotify.Event
+}
+
+func NewManager() (*Manager, error) {
+	fswatch, err := newFsnotifyBackend()
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Manager{
+		Logger:   log.New(os.Stderr, "", log.LstdFlags),
+		fswatch:  fswatch,
+		configs:  make(map[string]*Config),
+		running:  make(map[string]*pipeline),
+		stopping: make(chan struct{}),
+		finished: make(chan struct{}),
+	}
+	go m.loop()
+	return m, nil
+}
+
+/*
+  Add a pipeline, without starting it. Every pipeline needs a distinct
+  Config.Name, and pipelines can't watch the same directories or share a
+  Config.StateDir.
+*/
+func (m *Manager) Add(c *Config) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	others := make([]*Config, 0, len(m.names))
+	for _, name := range m.names {
+		others = append(others, m.configs[name])
+	}
+	if err := checkPipeline(others, c); err != nil {
+		return err
+	}
+
+	m.configs[c.Name] = c
+	m.names = append(m.names, c.Name)
+	return nil
+}
+
+/*
+  Check pipelines could all run in one Manager without starting anything:
+  each is valid, and they could all be added.
+*/
+func CheckPipelines(pipelines []*Config) error {
+	for i, c := range pipelines {
+		if err := c.Validate(); err != nil {
+			return fmt.Errorf("pipeline %q: %s", c.Name, err)
+		}
+		if err := checkPipeline(pipelines[:i], c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/* Can c be added alongside the pipelines in others? */
+func checkPipeline(others []*Config, c *Config) error {
+	if c.Name == "" {
+		return fmt.Errorf("pipelines need a name")
+	}
+	for _, o := range others {
+		if o.Name == c.Name {
+			return fmt.Errorf("there is already a pipeline called %q", c.Name)
+		}
+		if overlaps(o, c) {
+			return fmt.Errorf("pipelines %q and %q watch the same directory", o.Name, c.Name)
+		}
+		if sameStateDir(o, c) {
+			return fmt.Errorf("pipelines %q and %q use the same state directory", o.Name, c.Name)
+		}
+	}
+	return nil
+}
+
+/*
+  Would a and b end up watching the same directory?
+*/
+func overlaps(a, b *Config) bool {
+	da, erra := filepath.Abs(a.Dir)
+	db, errb := filepath.Abs(b.Dir)
+	if erra != nil || errb != nil {
+		return false
+	}
+	if da == db {
+		return true
+	}
+	below := func(dir, parent string) bool {
+		return strings.HasPrefix(dir, parent+string(os.PathSeparator))
+	}
+	return (a.Recursive && below(db, da)) || (b.Recursive && below(da, db))
+}
+
+/*
+  Do a and b keep their state in the same place? Each watcher compacts its
+  journal by replacing the file, which would lose the other's changes.
+*/
+func sameStateDir(a, b *Config) bool {
+	if a.StateDir == "" || b.StateDir == "" {
+		return false
+	}
+	da, erra := filepath.Abs(a.StateDir)
+	db, errb := filepath.Abs(b.StateDir)
+	return erra == nil && errb == nil && da == db
+}
+
+/* The names of all the pipelines, in the order they were added */
+func (m *Manager) Pipelines() []string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return append([]string(nil), m.names...)
+}
+
+func (m *Manager) Running(name string) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	_, ok := m.running[name]
+	return ok
+}
+
+/*
+  Start the named pipeline. A stopped pipeline can be started again.
+*/
+func (m *Manager) Start(name string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	select {
+	case <-m.stopping:
+		return fmt.Errorf("manager has been shut down")
+	default:
+	}
+
+	c, ok := m.configs[name]
+	if !ok {
+		return fmt.Errorf("no pipeline called %q", name)
+	}
+	if _, ok := m.running[name]; ok {
+		return fmt.Errorf("pipeline %q is already running", name)
+	}
+
+	if c.Logger == nil {
+		c.Logger = m.Logger
+	}
+	w := newWatcher(c)
+	p := &pipeline{watcher: w}
+	if c.Backend == "" || c.Backend == FsnotifyBackend {
+		w.backend = m.fswatch
+		w.shared = true
+		p.events = make(chan fsnotify.Event, pipelineEventBuffer)
+	} else {
+		backend, err := newBackend(c, w.error)
+		if err != nil {
+			return fmt.Errorf("pipeline %q: %s", name, err)
+		}
+		w.backend = backend
+	}
+	if err := w.start(); err != nil {
+		return fmt.Errorf("pipeline %q: %s", name, err)
+	}
+
+	m.running[name] = p
+	if w.shared {
+		go w.loop(p.events, nil, nil)
+	} else {
+		go w.loop(w.backend.Events(), nil, nil)
+	}
+
+	/* Watchers can stop themselves (eg Close), forget them when they do */
+	go func() {
+		<-w.finished
+		m.forget(name, p)
+	}()
+
+	m.Logger.Println("Started pipeline", name, "watching", c.Dir)
+	return nil
+}
+
+/* Start every pipeline which isn't running already */
+func (m *Manager) StartAll() error {
+	for _, name := range m.Pipelines() {
+		if m.Running(name) {
+			continue
+		}
+		if err := m.Start(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+  Stop the named pipeline gracefully, see Watcher.Shutdown. The other
+  pipelines carry on regardless.
+*/
+func (m *Manager) Stop(ctx context.Context, name string) ([]string, error) {
+	m.lock.Lock()
+	p, ok := m.running[name]
+	m.lock.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("pipeline %q is not running", name)
+	}
+
+	unprocessed, err := p.watcher.Shutdown(ctx)
+	m.forget(name, p)
+	m.Logger.Println("Stopped pipeline", name)
+	return unprocessed, err
+}
+
+/* Stop passing events on to a pipeline which has finished */
+func (m *Manager) forget(name string, p *pipeline) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.running[name] == p {
+		delete(m.running, name)
+	}
+}
+
+/*
+  Stop all the pipelines gracefully, at the same time, then the manager
+  itself. Returns the files left unprocessed by any of them, and the first
+  error.
+*/
+func (m *Manager) Shutdown(ctx context.Context) (unprocessed []string, err error) {
+	m.stopOnce.Do(func() { close(m.stopping) })
+	defer m.closeOnce.Do(func() {
+		m.fswatch.Close()
+		close(m.finished)
+	})
+
+	m.lock.Lock()
+	var names []string
+	for name := range m.running {
+		names = append(names, name)
+	}
+	m.lock.Unlock()
+
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	for _, name := range names {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			left, e := m.Stop(ctx, name)
+			lock.Lock()
+			defer lock.Unlock()
+			unprocessed = append(unprocessed, left...)
+			if e != nil && err == nil {
+				err = e
+			}
+		}(name)
+	}
+	wg.Wait()
+
+	sort.Strings(unprocessed)
+	return
+}
+
+/* Block until the manager has been shut down */
+func (m *Manager) Wait() {
+	<-m.finished
+}
+
+/*
+  Pass each event on to whichever pipelines are watching where it happened.
+*/
+func (m *Manager) loop() {
+	for {
+		select {
+		case event, ok := <-m.fswatch.Events():
+			if !ok {
+				return
+			}
+			m.route(event)
+		case err, ok := <-m.fswatch.Errors():
+			if !ok {
+				return
+			}
+			m.Logger.Println("Watch error:", err)
+		}
+	}
+}
+
+/*
+  Pass event on to the pipelines it's for. A busy pipeline can make us wait,
+  but not with the lock held (so it can still be stopped) and not once it's
+  stopping.
+*/
+func (m *Manager) route(event fsnotify.Event) {
+	dir := filepath.Dir(event.Name)
+	var targets []*pipeline
+	m.lock.Lock()
+	for _, p := range m.running {
+		if p.events == nil {
+			continue
+		}
+		/* Events for a watched directory itself (eg it's removed) matter too */
+		if p.watcher.watching(dir) || p.watcher.watching(event.Name) {
+			targets = append(targets, p)
+		}
+	}
+	m.lock.Unlock()
+
+	for _, p := range targets {
+		select {
+		case p.events <- event:
+		case <-p.watcher.stopping:
+		case <-p.watcher.finished:
+		}
+	}
+}
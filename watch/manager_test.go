@@ -0,0 +1,260 @@
+package watch
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+/* A bytes.Buffer the pipelines can log to at the same time */
+type syncBuffer struct {
+	lock sync.Mutex
+	buf  bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.String()
+}
+
+func TestManager(t *testing.T) {
+	mkTempDir := func() string {
+		s, e := ioutil.TempDir("", "springboard")
+		if e != nil {
+			panic(e)
+		}
+		return s
+	}
+	is := makeIs(t)
+	sep := string(os.PathSeparator)
+
+	inA, archA, inB, archB := mkTempDir(), mkTempDir(), mkTempDir(), mkTempDir()
+	for _, d := range []string{inA, archA, inB, archB} {
+		defer os.RemoveAll(d)
+	}
+
+	var logs syncBuffer
+	m, err := NewManager()
+	if err != nil {
+		panic(err)
+	}
+	m.Logger = log.New(&logs, "", 0)
+
+	a := &Config{Name: "a", Dir: inA, ArchiveDir: archA, Actions: []Action{&EchoAction{}}, ReportActions: true, ReportErrors: true}
+	is(m.Add(a), nil, "add a")
+	is(m.Add(&Config{Name: "b", Dir: inB, ArchiveDir: archB, Actions: []Action{&EchoAction{}}}), nil, "add b")
+	if m.Add(&Config{Name: "a", Dir: mkTempDir()}) == nil {
+		t.Fatal("added a second pipeline with the same name")
+	}
+	if m.Add(&Config{Name: "c", Dir: inA}) == nil {
+		t.Fatal("added a second pipeline for the same directory")
+	}
+	is(m.StartAll(), nil, "started")
+	is(m.Running("a") && m.Running("b"), true, "both running")
+
+	ioutil.WriteFile(inA+sep+"foo", []byte("a"), 0666)
+	ioutil.WriteFile(inB+sep+"bar", []byte("b"), 0666)
+	time.Sleep(200 * time.Millisecond)
+
+	makeFileIn(t, "foo")(archA, true, "a's file archived by a")
+	makeFileIn(t, "bar")(archB, true, "b's file archived by b")
+	is(strings.Contains(logs.String(), "[a] Archiving"), true, "shared logger, with the pipeline name")
+
+	/* Stopping one leaves the other alone */
+	_, err = m.Stop(context.Background(), "a")
+	is(err, nil, "stopped a")
+	is(m.Running("a"), false, "a stopped")
+	ioutil.WriteFile(inA+sep+"foo2", []byte("a"), 0666)
+	ioutil.WriteFile(inB+sep+"bar2", []byte("b"), 0666)
+	time.Sleep(200 * time.Millisecond)
+	makeFileIn(t, "foo2")(inA, true, "stopped pipeline ignores new files")
+	makeFileIn(t, "bar2")(archB, true, "other pipeline carries on")
+
+	/* and it can be started again */
+	a.ProcessExistingFiles = true
+	is(m.Start("a"), nil, "restarted a")
+	time.Sleep(200 * time.Millisecond)
+	makeFileIn(t, "foo2")(archA, true, "restarted pipeline picks up the file")
+
+	_, err = m.Shutdown(context.Background())
+	is(err, nil, "shutdown")
+	is(m.Running("a") || m.Running("b"), false, "nothing running")
+	if m.Start("a") == nil {
+		t.Fatal("started a pipeline after shutdown")
+	}
+	m.Wait()
+}
+
+func TestManagerState(t *testing.T) {
+	mkTempDir := func() string {
+		s, e := ioutil.TempDir("", "springboard")
+		if e != nil {
+			panic(e)
+		}
+		return s
+	}
+	is := makeIs(t)
+	sep := string(os.PathSeparator)
+
+	tempDir := mkTempDir()
+	defer os.RemoveAll(tempDir)
+	for _, d := range []string{"a", "b", "a-err", "b-err"} {
+		os.Mkdir(tempDir+sep+d, 0777)
+	}
+
+	/* Both pipelines fail every file, so both journals have something to remember */
+	path := writeConfig(t, tempDir, "c.yaml", `
+state_dir: `+tempDir+sep+`state
+paranoia: off
+actions:
+  - type: run
+    cmd: /bin/false
+pipelines:
+  - name: a
+    dir: `+tempDir+sep+`a
+    error_dir: `+tempDir+sep+`a-err
+  - name: b
+    dir: `+tempDir+sep+`b
+    error_dir: `+tempDir+sep+`b-err
+`)
+	pipelines, err := LoadPipelines(path, &Config{})
+	is(err, nil, "loaded")
+
+	m, err := NewManager()
+	if err != nil {
+		panic(err)
+	}
+	m.Logger = log.New(ioutil.Discard, "", 0)
+	for _, c := range pipelines {
+		is(m.Add(c), nil, "added "+c.Name)
+	}
+	if m.Add(&Config{Name: "c", Dir: tempDir + sep + "c", StateDir: pipelines[0].StateDir}) == nil {
+		t.Fatal("added a second pipeline with the same state directory")
+	}
+	is(m.StartAll(), nil, "started")
+
+	ioutil.WriteFile(tempDir+sep+"a"+sep+"foo", []byte("a"), 0666)
+	ioutil.WriteFile(tempDir+sep+"b"+sep+"bar", []byte("b"), 0666)
+	time.Sleep(300 * time.Millisecond)
+	_, err = m.Shutdown(context.Background())
+	is(err, nil, "shutdown")
+	m.Wait()
+
+	for name, file := range map[string]string{"a": "foo", "b": "bar"} {
+		j, err := openJournal(tempDir + sep + "state" + sep + name)
+		is(err, nil, name+" journal opened")
+		e, ok := j.get(tempDir + sep + name + "-err" + sep + file)
+		is(ok, true, name+" journal kept its failure")
+		is(e.State, FailedState, name+" failure recorded")
+		j.close()
+	}
+}
+
+func TestManagerBusyPipeline(t *testing.T) {
+	is := makeIs(t)
+	sep := string(os.PathSeparator)
+	inA, err := ioutil.TempDir("", "springboard")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(inA)
+	inB, err := ioutil.TempDir("", "springboard")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(inB)
+
+	m, err := NewManager()
+	if err != nil {
+		panic(err)
+	}
+	m.Logger = log.New(ioutil.Discard, "", 0)
+
+	/* a hangs on its first file, so its events back up */
+	action := cancellableAction{started: make(chan string, 1), err: make(chan error, 1)}
+	is(m.Add(&Config{Name: "a", Dir: inA, Workers: 1, Actions: []Action{&action}}), nil, "add a")
+	is(m.Add(&Config{Name: "b", Dir: inB, Actions: []Action{&EchoAction{}}}), nil, "add b")
+	is(m.StartAll(), nil, "started")
+
+	for i := 0; i < 2*pipelineEventBuffer; i++ {
+		ioutil.WriteFile(fmt.Sprint(inA, sep, i), []byte("a"), 0666)
+	}
+	<-action.started
+	time.Sleep(200 * time.Millisecond)
+	is(m.Running("b"), true, "manager still answers")
+
+	done := make(chan error)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+		defer cancel()
+		_, err := m.Shutdown(ctx)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		is(err, context.DeadlineExceeded, "a's file interrupted")
+	case <-time.After(3 * time.Second):
+		t.Fatal("shutdown stuck behind a busy pipeline")
+	}
+	m.Wait()
+}
+
+func TestCheckPipelines(t *testing.T) {
+	is := makeIs(t)
+	actions := []Action{&EchoAction{}}
+	a := &Config{Name: "a", Dir: "/in/a", StateDir: "/state/a", Actions: actions}
+	b := &Config{Name: "b", Dir: "/in/b", StateDir: "/state/b", Actions: actions}
+	is(CheckPipelines([]*Config{a, b}), nil, "fine together")
+
+	for describe, c := range map[string]*Config{
+		"same name":      {Name: "a", Dir: "/in/c", Actions: actions},
+		"same dir":       {Name: "c", Dir: "/in/a", Actions: actions},
+		"same state dir": {Name: "c", Dir: "/in/c", StateDir: "/state/b", Actions: actions},
+		"no name":        {Dir: "/in/c", Actions: actions},
+		"invalid":        {Name: "c", Dir: "/in/c"},
+	} {
+		if CheckPipelines([]*Config{a, b, c}) == nil {
+			t.Fatal(describe, " passed")
+		}
+	}
+}
+
+func TestManagerBadPipeline(t *testing.T) {
+	is := makeIs(t)
+	inA, err := ioutil.TempDir("", "springboard")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(inA)
+
+	m, err := NewManager()
+	if err != nil {
+		panic(err)
+	}
+	m.Logger = log.New(ioutil.Discard, "", 0)
+	actions := []Action{&EchoAction{}}
+	is(m.Add(&Config{Name: "a", Dir: inA, Actions: actions}), nil, "add a")
+	is(m.Add(&Config{Name: "gone", Dir: inA + "-gone", ProcessExistingFiles: true, Actions: actions}), nil, "add gone")
+
+	is(m.Start("a"), nil, "started a")
+	is(m.Start("gone") != nil, true, "missing directory is an error")
+	is(m.Running("a"), true, "a carries on")
+	is(m.Running("gone"), false, "gone isn't running")
+
+	_, err = m.Shutdown(context.Background())
+	is(err, nil, "shutdown")
+}
@@ -0,0 +1,96 @@
+package watch
+
+import (
+	"os"
+	"strings"
+)
+
+/* Marker suffixes used with MarkerParanoia unless Config.MarkerSuffixes says otherwise */
+var DefaultMarkerSuffixes = []string{".done", ".ok"}
+
+/*
+  With MarkerParanoia a file is only ready once whoever is writing it creates
+  a marker next to it, eg foo.xml.done for foo.xml. Files ending in a marker
+  suffix are always treated as markers, never processed themselves.
+*/
+func (w *Watcher) markerSuffixes() []string {
+	if len(w.Config.MarkerSuffixes) > 0 {
+		return w.Config.MarkerSuffixes
+	}
+	return DefaultMarkerSuffixes
+}
+
+/*
+  The file path is a marker for, or path itself if it isn't a marker (or
+  we're not using markers).
+*/
+func (w *Watcher) markedFile(path string) string {
+	if w.Config.Paranoia != MarkerParanoia {
+		return path
+	}
+	for _, suffix := range w.markerSuffixes() {
+		if strings.HasSuffix(path, suffix) && len(path) > len(suffix) {
+			return strings.TrimSuffix(path, suffix)
+		}
+	}
+	return path
+}
+
+func (w *Watcher) isMarker(path string) bool {
+	return w.markedFile(path) != path
+}
+
+/* The marker for the file at path, "" if it hasn't got one (yet) */
+func (w *Watcher) markerFor(path string) string {
+	for _, suffix := range w.markerSuffixes() {
+		if _, err := os.Stat(path + suffix); err == nil {
+			return path + suffix
+		}
+	}
+	return ""
+}
+
+/*
+  Swap any markers in paths for the files they mark, without listing a file
+  twice when both it and its marker are there.
+*/
+func (w *Watcher) markedFiles(paths []string) (files []string) {
+	seen := make(map[string]bool)
+	for _, path := range paths {
+		path = w.markedFile(path)
+		if !seen[path] {
+			seen[path] = true
+			files = append(files, path)
+		}
+	}
+	return
+}
+
+/*
+  Tidy up the marker of a file we've finished with (rel being the file's
+  path relative to where it was): moved into dir along with the file if
+  Config.ArchiveMarkers is set, otherwise deleted.
+*/
+func (w *Watcher) finishMarker(path, rel, dir string) {
+	if w.Config.Paranoia != MarkerParanoia {
+		return
+	}
+	marker := w.markerFor(path)
+	if marker == "" {
+		return
+	}
+
+	if w.Config.ArchiveMarkers {
+		if dir == "" {
+			/* The file's staying put, so does its marker */
+			return
+		}
+		if _, err := moveFile(marker, dir, rel+strings.TrimPrefix(marker, path)); err != nil {
+			w.error(err)
+		}
+		return
+	}
+	if err := os.Remove(marker); err != nil {
+		w.error("Could not remove marker: ", err)
+	}
+}
@@ -0,0 +1,82 @@
+package watch
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestMarker(t *testing.T) {
+	mkTempDir := func() string {
+		s, e := ioutil.TempDir("", "springboard")
+		if e != nil {
+			panic(e)
+		}
+		return s
+	}
+	sep := string(os.PathSeparator)
+
+	for _, archiveMarkers := range []bool{false, true} {
+		tempDir := mkTempDir()
+		archDir := mkTempDir()
+		defer os.RemoveAll(tempDir)
+		defer os.RemoveAll(archDir)
+
+		/* Already there with its marker */
+		ioutil.WriteFile(tempDir+sep+"old", []byte("x"), 0666)
+		ioutil.WriteFile(tempDir+sep+"old.done", nil, 0666)
+
+		processed := make(chan string, 10)
+		cfg := Config{
+			dontBlock:            true,
+			Dir:                  tempDir,
+			ArchiveDir:           archDir,
+			ProcessExistingFiles: true,
+			Paranoia:             MarkerParanoia,
+			MarkerSuffixes:       []string{".done", ".ready"},
+			ArchiveMarkers:       archiveMarkers,
+			AfterFileAction: func(file string, result *Result) {
+				processed <- file
+			},
+		}
+		if err := Watch(&cfg); err != nil {
+			t.Fatal(err)
+		}
+
+		is := makeIs(t)
+		is(<-processed, tempDir+sep+"old", "existing file with a marker processed")
+
+		ioutil.WriteFile(tempDir+sep+"foo", []byte("x"), 0666)
+		select {
+		case <-processed:
+			t.Fatal("processed without a marker")
+		case <-time.After(200 * time.Millisecond):
+		}
+		makeFileIn(t, "foo")(tempDir, true, "file waits for its marker")
+
+		ioutil.WriteFile(tempDir+sep+"foo.ready", nil, 0666)
+		is(<-processed, tempDir+sep+"foo", "processed once the marker appears")
+		select {
+		case f := <-processed:
+			t.Fatal("processed twice ", f)
+		case <-time.After(200 * time.Millisecond):
+		}
+
+		makeFileIn(t, "foo")(archDir, true, "file archived")
+		makeFileIn(t, "foo.ready")(tempDir, false, "marker gone from the watched directory")
+		makeFileIn(t, "foo.ready")(archDir, archiveMarkers, "marker archived only if asked")
+		makeFileIn(t, "old.done")(archDir, archiveMarkers, "existing marker archived only if asked")
+	}
+}
+
+func TestMarkedFile(t *testing.T) {
+	is := makeIs(t)
+	w := newWatcher(&Config{Paranoia: MarkerParanoia})
+	is(w.markedFile("/in/foo.xml.ok"), "/in/foo.xml", "default suffix")
+	is(w.markedFile("/in/foo.xml"), "/in/foo.xml", "not a marker")
+	is(len(w.markedFiles([]string{"/in/a", "/in/a.done", "/in/b.ok"})), 2, "file and marker listed once")
+
+	w = newWatcher(&Config{Paranoia: BasicParanoia})
+	is(w.markedFile("/in/foo.xml.ok"), "/in/foo.xml.ok", "no markers without marker paranoia")
+}
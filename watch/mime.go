@@ -0,0 +1,57 @@
+package watch
+
+import (
+	"fmt"
+	"mime"
+	"path/filepath"
+	"strings"
+)
+
+/* What we send when we can't tell what a file is */
+const fallbackMime = "application/octet-stream"
+
+/*
+  Work out the type of file for PostAction when it hasn't been given one.
+  In order we try: extra, a map of extensions to types (eg "xml" or ".xml"
+  to "application/xml"), the system's list of extensions, and finally the
+  file's content.
+*/
+func detectMime(file string, extra map[string]string) string {
+	ext := strings.ToLower(filepath.Ext(file))
+	if ext != "" {
+		for e, t := range extra {
+			if normalExt(e) == ext {
+				return t
+			}
+		}
+		if t := mime.TypeByExtension(ext); t != "" {
+			return t
+		}
+	}
+
+	sniffed, err := sniffContentType(file)
+	if err != nil {
+		return fallbackMime
+	}
+	return sniffed
+}
+
+/* An extension as filepath.Ext gives them, eg XML becomes .xml */
+func normalExt(ext string) string {
+	return "." + strings.ToLower(strings.TrimPrefix(strings.TrimSpace(ext), "."))
+}
+
+/*
+  Split an ext=type mapping from the command line, eg xml=application/xml.
+*/
+func ParseMimeMapping(mapping string) (ext, mimeType string, err error) {
+	i := strings.Index(mapping, "=")
+	if i <= 0 || i == len(mapping)-1 {
+		return "", "", fmt.Errorf("bad mime mapping %q, use EXT=TYPE", mapping)
+	}
+	ext, mimeType = strings.TrimSpace(mapping[:i]), strings.TrimSpace(mapping[i+1:])
+	if _, _, err := mime.ParseMediaType(mimeType); err != nil {
+		return "", "", fmt.Errorf("bad mime type %q: %s", mimeType, err)
+	}
+	return ext, mimeType, nil
+}
@@ -0,0 +1,45 @@
+package watch
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestDetectMime(t *testing.T) {
+	is := makeIs(t)
+	tempDir, err := ioutil.TempDir("", "springboard")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	file := func(name, content string) string {
+		path := tempDir + string(os.PathSeparator) + name
+		ioutil.WriteFile(path, []byte(content), 0666)
+		return path
+	}
+	pdf := "%PDF-1.4\n"
+	extra := map[string]string{"ZZZ": "application/x-zzz", ".po": "application/purchase-order"}
+
+	is(detectMime(file("a.zzz", pdf), extra), "application/x-zzz", "extension from our map")
+	is(detectMime(file("a.po", "<order/>"), extra), "application/purchase-order", "dotted extension from our map")
+	is(detectMime(file("a.Html", pdf), nil), "text/html; charset=utf-8", "system extension, ignoring case")
+	is(detectMime(file("a.unknown", pdf), nil), "application/pdf", "sniffed content")
+	is(detectMime(file("noext", "hello"), nil), "text/plain; charset=utf-8", "sniffed text")
+	is(detectMime(tempDir+string(os.PathSeparator)+"gone", nil), fallbackMime, "can't read it")
+}
+
+func TestParseMimeMapping(t *testing.T) {
+	is := makeIs(t)
+	ext, mimeType, err := ParseMimeMapping("xml = application/xml")
+	is(err, nil, "parsed")
+	is(ext, "xml", "extension")
+	is(mimeType, "application/xml", "type")
+
+	for _, bad := range []string{"xml", "=application/xml", "xml=", "xml=not a type"} {
+		if _, _, err := ParseMimeMapping(bad); err == nil {
+			t.Fatal(bad, " accepted")
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package watch
+
+import (
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/textproto"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+/* The form field PostAction.Multipart puts the file in unless PostAction.FieldName says otherwise */
+const DefaultFieldName = "file"
+
+var quoteEscaper = strings.NewReplacer("\\", "\\\\", `"`, "\\\"")
+
+/*
+  A multipart/form-data body for file, as an HTML form uploading it would
+  send: the extra form fields, then the file itself. The body is written as
+  it's read, so we never hold the file in memory. Returns the body and the
+  request's content type.
+*/
+func (a *PostAction) multipartBody(file *fileDetails, templates *postTemplates, content io.Reader, mimeType string) (io.ReadCloser, string, error) {
+	fields, err := fillTemplates("form field", templates.form, file)
+	if err != nil {
+		return nil, "", err
+	}
+	uploadName := filepath.Base(file.path)
+	if templates.uploadName != nil {
+		if uploadName, err = fillTemplate("upload name", templates.uploadName, file); err != nil {
+			return nil, "", err
+		}
+	}
+	fieldName := a.FieldName
+	if fieldName == "" {
+		fieldName = DefaultFieldName
+	}
+
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		for _, name := range names {
+			if err := mw.WriteField(name, fields[name]); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+
+		h := make(textproto.MIMEHeader)
+		h.Set("Content-Disposition", fmt.Sprintf(`form-data; name="%s"; filename="%s"`,
+			quoteEscaper.Replace(fieldName), quoteEscaper.Replace(uploadName)))
+		h.Set("Content-Type", mimeType)
+		part, err := mw.CreatePart(h)
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		if _, err := io.Copy(part, content); err != nil {
+			pw.CloseWithError(fmt.Errorf("Error reading file %s %s", file.path, err))
+			return
+		}
+		pw.CloseWithError(mw.Close())
+	}()
+	return pr, mw.FormDataContentType(), nil
+}
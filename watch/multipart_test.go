@@ -0,0 +1,92 @@
+package watch
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+)
+
+func TestMultipart(t *testing.T) {
+	is := makeIs(t)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	type upload struct {
+		fields      map[string][]string
+		field       string
+		filename    string
+		contentType string
+		content     string
+		err         error
+	}
+	got := make(chan upload, 1)
+	s := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var u upload
+			defer func() { got <- u }()
+			if u.err = r.ParseMultipartForm(1 << 20); u.err != nil {
+				return
+			}
+			u.fields = r.MultipartForm.Value
+			for field, files := range r.MultipartForm.File {
+				u.field = field
+				u.filename = files[0].Filename
+				u.contentType = files[0].Header.Get("Content-Type")
+				f, err := files[0].Open()
+				if err != nil {
+					u.err = err
+					return
+				}
+				content, _ := ioutil.ReadAll(f)
+				f.Close()
+				u.content = string(content)
+			}
+		}),
+	}
+	go s.Serve(l)
+	defer s.Close()
+
+	tempDir, err := ioutil.TempDir("", "springboard")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tempDir)
+	file := tempDir + string(os.PathSeparator) + "order.xml"
+	ioutil.WriteFile(file, []byte("<order/>"), 0666)
+
+	a := &PostAction{
+		To:        "http://" + l.Addr().String(),
+		Mime:      "application/xml",
+		Multipart: true,
+		Form:      map[string]string{"source": "springboard", "size": "{{.Size}}"},
+	}
+	w := newWatcher(&Config{})
+	is(a.Process(context.Background(), w, file).Ok(), true, "posted")
+	u := <-got
+	is(u.err, nil, "valid form")
+	is(u.field, DefaultFieldName, "default field name")
+	is(u.filename, "order.xml", "file's own name")
+	is(u.contentType, "application/xml", "file's type")
+	is(u.content, "<order/>", "file content")
+	is(len(u.fields), 2, "form fields")
+	is(u.fields["source"][0], "springboard", "plain field")
+	is(u.fields["size"][0], "8", "templated field")
+
+	a = &PostAction{
+		To:         "http://" + l.Addr().String(),
+		Mime:       "application/xml",
+		Multipart:  true,
+		FieldName:  "upload",
+		UploadName: `{{.Name}} "copy"`,
+	}
+	is(a.Process(context.Background(), w, file).Ok(), true, "posted again")
+	u = <-got
+	is(u.field, "upload", "field name")
+	is(u.filename, `order.xml "copy"`, "upload name")
+	is(len(u.fields), 0, "no form fields")
+}
@@ -1,62 +1,210 @@
 package watch
 
 import (
+	"context"
+	"fmt"
+	"io"
 	"net/http"
 	"os"
+	"strings"
+	"sync"
+	"text/template"
 	"time"
 )
 
+/* How long a POST can take if PostAction.Timeout isn't set */
+const DefaultPostTimeout = 120 * time.Second
+
+/* The HTTP methods PostAction can send files with, the first is the default */
+var PostMethods = []string{http.MethodPost, http.MethodPut, http.MethodPatch}
+
+/* Check method is one of PostMethods, returning it in upper case */
+func ParseMethod(method string) (string, error) {
+	method = strings.ToUpper(strings.TrimSpace(method))
+	for _, m := range PostMethods {
+		if m == method {
+			return method, nil
+		}
+	}
+	return "", fmt.Errorf("unknown method %q, use one of %s", method, strings.Join(PostMethods, ", "))
+}
+
 type PostAction struct {
-	To                string
-	Mime              string
+	To                string            /* Where to send files, can be a template using the file's details, see templateFile */
+	Method            string            /* One of PostMethods, POST if not set */
+	SuccessCodes      StatusCodes       /* The response codes which mean the server has the file, DefaultSuccessCodes if not set */
+	Mime              string            /* Content type to send, if not set we work it out from the file, see MimeMap */
+	MimeMap           map[string]string /* Content types by extension (eg "pdf": "application/pdf"), tried before the system's and sniffing the file */
 	BasicAuthUsername string
 	BasicAuthPwd      string
+	Timeout           time.Duration     /* Give up on the request after this long, DefaultPostTimeout if not set */
+	Headers           map[string]string /* Extra headers, the values can be templates using the file's details, see templateFile */
+	Multipart         bool              /* Send the file as a multipart/form-data upload, as an HTML form would, rather than as the whole body */
+	FieldName         string            /* With Multipart, the form field the file goes in, DefaultFieldName if not set */
+	UploadName        string            /* With Multipart, the filename to give the server (a template, as Headers), the file's own name if not set */
+	Form              map[string]string /* With Multipart, extra form fields sent before the file, the values can be templates as Headers */
+
+	/* The templates above, parsed the first time they're needed, so set them before using the action */
+	parseOnce sync.Once
+	parsed    *postTemplates
+	parseErr  error
+}
+
+/* A PostAction's templates, parsed */
+type postTemplates struct {
+	to         *urlTemplate /* nil if PostAction.To has nothing to fill in */
+	headers    map[string]*template.Template
+	form       map[string]*template.Template
+	uploadName *template.Template /* nil if PostAction.UploadName isn't set */
 }
 
-func (a *PostAction) Process(w *Watcher, file string) bool {
-	w.report_action("Attempting to post ", file, " to ", a.To)
+/*
+  Check the action's templates (To, Headers, UploadName and Form) can be
+  used, so mistakes are found before there are any files.
+*/
+func (a *PostAction) Check() error {
+	_, err := a.templates()
+	return err
+}
+
+/*
+  Parse (and check) the action's templates, the first time it's asked.
+*/
+func (a *PostAction) templates() (*postTemplates, error) {
+	a.parseOnce.Do(func() {
+		t := &postTemplates{}
+		if t.to, a.parseErr = parseURLTemplate(a.To); a.parseErr != nil {
+			return
+		}
+		if t.headers, a.parseErr = parseHeaders(a.Headers); a.parseErr != nil {
+			return
+		}
+		if t.form, a.parseErr = parseTemplates("form field", a.Form); a.parseErr != nil {
+			return
+		}
+		if a.UploadName != "" {
+			if t.uploadName, a.parseErr = parseTemplate("upload name", "filename", a.UploadName); a.parseErr != nil {
+				return
+			}
+		}
+		a.parsed = t
+	})
+	return a.parsed, a.parseErr
+}
+
+func (a *PostAction) Process(ctx context.Context, w *Watcher, file string) *Result {
+	method := http.MethodPost
+	if a.Method != "" {
+		m, err := ParseMethod(a.Method)
+		if err != nil {
+			return Failed(err)
+		}
+		method = m
+	}
+	templates, err := a.templates()
+	if err != nil {
+		return Failed(err)
+	}
+	details, err := newFileDetails(file, w.relPath(file))
+	if err != nil {
+		return Failed(fmt.Errorf("Error opening file %s %s", file, err))
+	}
+	to, err := a.url(templates, details)
+	if err != nil {
+		return Failed(err)
+	}
+	w.report_action("Attempting to ", method, " ", file, " to ", to)
 	mime_type := a.Mime
 	reader, err := os.Open(file)
 
 	if err != nil {
-		w.error("Error opeing file ", file, " ", err)
-		return false
+		return Failed(fmt.Errorf("Error opening file %s %s", file, err))
 	}
+	defer reader.Close()
 
 	if mime_type == "" {
-		// TODO: better
-		mime_type = "text/plain"
+		mime_type = detectMime(file, a.MimeMap)
+		w.debug("Sending ", file, " as ", mime_type)
 	}
 
-	req, err := http.NewRequest("POST", a.To, reader)
+	var body io.Reader = reader
+	content_type := mime_type
+	if a.Multipart {
+		form, form_type, err := a.multipartBody(details, templates, reader, mime_type)
+		if err != nil {
+			return Failed(fmt.Errorf("Error building form: %s", err))
+		}
+		defer form.Close()
+		body, content_type = form, form_type
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, to, body)
 
 	if err != nil {
-		w.error("Error building request: ", err)
-		return false
+		return Failed(fmt.Errorf("Error building request: %s", err))
 	}
 
-	req.Header.Set("Content-Type", mime_type)
+	req.Header.Set("Content-Type", content_type)
+
+	if len(templates.headers) > 0 {
+		headers, err := fileHeaders(templates.headers, details)
+		if err != nil {
+			return Failed(fmt.Errorf("Error building headers: %s", err))
+		}
+		for key, values := range headers {
+			req.Header[key] = values
+		}
+	}
 
 	if len(a.BasicAuthUsername) > 0 {
 		req.SetBasicAuth(a.BasicAuthUsername, a.BasicAuthPwd)
 	}
 
+	timeout := a.Timeout
+	if timeout <= 0 {
+		timeout = DefaultPostTimeout
+	}
 	var cli = &http.Client{
-		Timeout: time.Second * 120,
+		Timeout: timeout,
 	}
 	rsp, err := cli.Do(req)
 
 	if err != nil {
-		w.error("Posting ", file, " to ", a.To, " failed ", err)
-		return false
+		return Retryable(fmt.Errorf("Sending %s to %s failed %s", file, to, err)).Set("url", to)
 	}
+	defer rsp.Body.Close()
 
 	w.debug("Got response ", rsp.Status)
-	if rsp.StatusCode != http.StatusOK {
-		w.error( "POST failed ", rsp.Status )
-		return false
+	success := a.SuccessCodes
+	if len(success) == 0 {
+		success = DefaultSuccessCodes
+	}
+	if !success.Has(rsp.StatusCode) {
+		err := fmt.Errorf("%s failed %s", method, rsp.Status)
+		result := Failed(err)
+		if retryableStatus(rsp.StatusCode) {
+			result = Retryable(err)
+		}
+		return result.Set("url", to).Set("http_status", rsp.StatusCode)
 	}
 
-	w.report_action("POST sucessful")
-	return true
+	w.report_action(method, " sucessful")
+	return Succeeded().Set("url", to).Set("http_status", rsp.StatusCode)
+}
+
+/* Where to send file, filling in To if it's a template */
+func (a *PostAction) url(templates *postTemplates, file *fileDetails) (string, error) {
+	if templates.to == nil {
+		return a.To, nil
+	}
+	return templates.to.expand(file)
+}
+
+/*
+  Server errors & rate limiting might go away if we try again, anything else
+  (eg a 400 or 404) won't. Codes in PostAction.SuccessCodes never get this
+  far.
+*/
+func retryableStatus(code int) bool {
+	return code >= 500 || code == http.StatusTooManyRequests
 }
@@ -1,12 +1,15 @@
 package watch
 
 import (
+	"context"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"testing"
 	"net/http"
 	"net"
 	"log"
+	"time"
 )
 
 
@@ -41,7 +44,7 @@ func Test_PostOK(t *testing.T){
 	if err != nil {
 	 	panic(err)
 	}
-	wait := make( chan bool )
+	wait := make( chan *Result )
 
 	defer func() { os.Remove(tempDir) }()
 	cfg := Config{
@@ -54,8 +57,8 @@ func Test_PostOK(t *testing.T){
 				Mime : "text/ralf",
 			},
 		},
-		AfterFileAction : func( file string ){
-			wait <- true
+		AfterFileAction : func(file string, result *Result) {
+			wait <- result
 		},
 	}
 
@@ -70,11 +73,13 @@ func Test_PostOK(t *testing.T){
 	tempFile.Close()
 	os.Rename( tempFile.Name(), tempDir + string(os.PathSeparator) + "foo")
 
-	<- wait
+	result := <- wait
 
 	is( stuffHappened, true, "Post recieved")
 	is( readOk, true, "Able to read body")
 	is( body, "kruncha6", "Body checks out")
+	is( result.Ok(), true, "Result ok")
+	is( result.Meta["http_status"], "200", "Status reported")
 }
 
 func Test_PostFail(t *testing.T){
@@ -101,7 +106,7 @@ func Test_PostFail(t *testing.T){
 				Mime : "text/ralf",
 			},
 		},
-		AfterFileAction : func( file string ){
+		AfterFileAction : func(file string, result *Result) {
 			wait <- true
 		},
 	}
@@ -164,7 +169,7 @@ func TestBasicAuth(t *testing.T){
 				BasicAuthPwd : "therappa",
 			},
 		},
-		AfterFileAction : func( file string ){
+		AfterFileAction : func(file string, result *Result) {
 			wait <- true
 		},
 	}
@@ -189,3 +194,296 @@ func TestBasicAuth(t *testing.T){
 	is( pwd, "therappa", "Password")
 	is( ba, true, "Some basic auth happened")
 }
+
+func TestPostTimeout(t *testing.T) {
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	mine := l.Addr().String()
+	hang := make(chan bool)
+	defer close(hang)
+	s := &http.Server{
+		Addr: mine,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-hang
+		}),
+	}
+
+	l.Close()
+	go s.ListenAndServe()
+
+	tempDir, err := ioutil.TempDir("", "springboard")
+	if err != nil {
+		panic(err)
+	}
+	archDir, err := ioutil.TempDir("", "springboard")
+	if err != nil {
+		panic(err)
+	}
+	defer func() { os.RemoveAll(tempDir) }()
+	defer func() { os.RemoveAll(archDir) }()
+
+	wait := make(chan bool)
+	cfg := Config{
+		dontBlock:  true,
+		Dir:        tempDir,
+		ArchiveDir: archDir,
+		Actions: []Action{
+			&PostAction{
+				To:      "http://" + mine,
+				Timeout: 100 * time.Millisecond,
+			},
+		},
+		AfterFileAction: func(file string, result *Result) {
+			wait <- true
+		},
+	}
+
+	Watch(&cfg)
+	start := time.Now()
+	_, err = os.Create(tempDir + string(os.PathSeparator) + "foo")
+	if err != nil {
+		panic(err)
+	}
+	<-wait
+
+	if time.Since(start) > 2*time.Second {
+		t.Error("Post didn't time out")
+	}
+	makeFileIn(t, "foo")(archDir, false, "timed out post isn't archived")
+}
+
+func TestPostStatusOutcome(t *testing.T) {
+	is := makeIs(t)
+
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	mine := l.Addr().String()
+	statuses := make(chan int, 1)
+	s := &http.Server{
+		Addr: mine,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(<-statuses)
+		}),
+	}
+
+	l.Close()
+	go s.ListenAndServe()
+
+	tempDir, err := ioutil.TempDir("", "springboard")
+	if err != nil {
+		panic(err)
+	}
+	defer func() { os.RemoveAll(tempDir) }()
+
+	wait := make(chan *Result)
+	cfg := Config{
+		dontBlock: true,
+		Dir:       tempDir,
+		Workers:   1,
+		Actions: []Action{
+			&PostAction{
+				To: "http://" + mine,
+			},
+		},
+		AfterFileAction: func(file string, result *Result) {
+			wait <- result
+		},
+	}
+
+	Watch(&cfg)
+
+	for _, c := range []struct {
+		status  int
+		outcome Outcome
+	}{
+		{http.StatusServiceUnavailable, RetryOutcome},
+		{http.StatusTooManyRequests, RetryOutcome},
+		{http.StatusNotFound, FailureOutcome},
+	} {
+		statuses <- c.status
+		_, err = os.Create(fmt.Sprintf("%s%s%d", tempDir, string(os.PathSeparator), c.status))
+		if err != nil {
+			panic(err)
+		}
+		result := <-wait
+		is(result.Outcome, c.outcome, fmt.Sprint("outcome for ", c.status))
+		is(result.Meta["http_status"], fmt.Sprint(c.status), fmt.Sprint("status for ", c.status))
+	}
+}
+
+func TestPostHeaders(t *testing.T) {
+	is := makeIs(t)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	mine := l.Addr().String()
+	got := make(chan http.Header, 1)
+	s := &http.Server{
+		Addr: mine,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got <- r.Header
+		}),
+	}
+
+	go s.Serve(l)
+	defer s.Close()
+
+	tempDir, err := ioutil.TempDir("", "springboard")
+	if err != nil {
+		panic(err)
+	}
+	defer func() { os.RemoveAll(tempDir) }()
+	file := tempDir + string(os.PathSeparator) + "foo.xml"
+	ioutil.WriteFile(file, []byte("kruncha"), 0666)
+	modified := time.Date(2020, 2, 3, 4, 5, 6, 0, time.UTC)
+	os.Chtimes(file, modified, modified)
+
+	a := &PostAction{
+		To: "http://" + mine,
+		Headers: map[string]string{
+			"X-Filename":  "{{.Name}}",
+			"X-Size":      "{{.Size}} bytes",
+			"X-Sha256":    "{{.SHA256}}",
+			"Content-MD5": "{{.MD5}}",
+			"X-Modified":  "{{.ModTime}}",
+			"X-Type":      "{{.Ext}}",
+			"X-Source":    "springboard",
+		},
+	}
+	w := newWatcher(&Config{})
+	result := a.Process(context.Background(), w, file)
+	is(result.Ok(), true, "posted")
+
+	h := <-got
+	is(h.Get("X-Filename"), "foo.xml", "filename")
+	is(h.Get("X-Size"), "7 bytes", "size")
+	is(h.Get("X-Sha256"), "fc5a43f8b7e41995c723f950e285a44bd49355c32cd4d223827d6941cb49fcb7", "sha256")
+	is(h.Get("Content-MD5"), "ieiACg01us2AezCA6idr7A==", "md5")
+	is(h.Get("X-Modified"), "2020-02-03T04:05:06Z", "modified, as in URLs")
+	is(h.Get("X-Type"), "xml", "the same details as URLs")
+	is(h.Get("X-Source"), "springboard", "plain header")
+
+	a = &PostAction{To: "http://" + mine, Headers: map[string]string{"X-Broken": "{{.Nope}}"}}
+	is(a.Process(context.Background(), w, file).Outcome, FailureOutcome, "bad template fails")
+}
+
+func TestParseHeader(t *testing.T) {
+	is := makeIs(t)
+
+	key, value, err := ParseHeader("X-Filename: {{.Name}}")
+	is(err, nil, "good header")
+	is(key, "X-Filename", "key")
+	is(value, "{{.Name}}", "value")
+	_, _, err = ParseHeader("X-Filename")
+	is(err != nil, true, "no value rejected")
+	_, _, err = ParseHeader(" : x")
+	is(err != nil, true, "no name rejected")
+
+	key, value, err = ParseFormField("name={{.Name}}")
+	is(err, nil, "good form field")
+	is(key+" "+value, "name {{.Name}}", "form field split")
+	_, _, err = ParseFormField("name")
+	is(err != nil, true, "form field with no value rejected")
+}
+
+func TestPostCheck(t *testing.T) {
+	is := makeIs(t)
+
+	is((&PostAction{To: "http://x/{{.Name}}", Headers: map[string]string{"X-Sha256": "{{.SHA256}}"}}).Check(), nil, "hashes don't need a file")
+	for describe, a := range map[string]*PostAction{
+		"unknown header field":      {To: "http://x", Headers: map[string]string{"X-Filename": "{{.Filename}}"}},
+		"broken header":             {To: "http://x", Headers: map[string]string{"X-Filename": "{{.Name"}},
+		"unknown form field":        {To: "http://x", Form: map[string]string{"name": "{{.Filename}}"}},
+		"unknown upload name field": {To: "http://x", UploadName: "{{.Bad}}"},
+		"unknown URL field":         {To: "http://x/{{.Filename}}"},
+	} {
+		if a.Check() == nil {
+			t.Fatal(describe, " passed")
+		}
+	}
+}
+
+func TestPostMethodAndCodes(t *testing.T) {
+	is := makeIs(t)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	methods := make(chan string, 1)
+	statuses := make(chan int, 1)
+	s := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			methods <- r.Method
+			w.WriteHeader(<-statuses)
+		}),
+	}
+	go s.Serve(l)
+	defer s.Close()
+
+	tempDir, err := ioutil.TempDir("", "springboard")
+	if err != nil {
+		panic(err)
+	}
+	defer func() { os.RemoveAll(tempDir) }()
+	file := tempDir + string(os.PathSeparator) + "foo"
+	ioutil.WriteFile(file, []byte("kruncha"), 0666)
+
+	w := newWatcher(&Config{})
+	a := &PostAction{To: "http://" + l.Addr().String()}
+	statuses <- http.StatusCreated
+	result := a.Process(context.Background(), w, file)
+	is(<-methods, "POST", "POST by default")
+	is(result.Outcome, FailureOutcome, "only 200 is success by default")
+
+	a.Method = "put"
+	a.SuccessCodes, _ = ParseStatusCodes("200-299,409")
+	statuses <- http.StatusCreated
+	result = a.Process(context.Background(), w, file)
+	is(<-methods, "PUT", "method")
+	is(result.Ok(), true, "201 in the success codes")
+	is(result.Meta["http_status"], "201", "status reported")
+
+	statuses <- http.StatusConflict
+	is(a.Process(context.Background(), w, file).Ok(), true, "409 in the success codes")
+	<-methods
+
+	statuses <- http.StatusBadRequest
+	is(a.Process(context.Background(), w, file).Outcome, FailureOutcome, "400 is permanent")
+	<-methods
+
+	a.Method = "DELETE"
+	is(a.Process(context.Background(), w, file).Outcome, FailureOutcome, "unknown method")
+}
+
+func TestPostURLTemplate(t *testing.T) {
+	is := makeIs(t)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	uris := make(chan string, 1)
+	s := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			uris <- r.URL.RequestURI()
+		}),
+	}
+	go s.Serve(l)
+	defer s.Close()
+
+	tempDir, err := ioutil.TempDir("", "springboard")
+	if err != nil {
+		panic(err)
+	}
+	defer func() { os.RemoveAll(tempDir) }()
+	file := tempDir + string(os.PathSeparator) + "my order.xml"
+	ioutil.WriteFile(file, []byte("kruncha"), 0666)
+
+	w := newWatcher(&Config{Dir: tempDir})
+	a := &PostAction{To: "http://" + l.Addr().String() + "/files/{{.Name}}?type={{.Ext}}"}
+	result := a.Process(context.Background(), w, file)
+	is(result.Ok(), true, "posted")
+	is(<-uris, "/files/my%20order.xml?type=xml", "URL filled in")
+	is(result.Meta["url"], "http://"+l.Addr().String()+"/files/my%20order.xml?type=xml", "filled in URL reported")
+}
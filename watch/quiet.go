@@ -0,0 +1,73 @@
+package watch
+
+import (
+	"context"
+	"time"
+)
+
+/* How long EventParanoia waits after the last write unless Config.QuietPeriod says otherwise */
+const DefaultQuietPeriod = 2 * time.Second
+
+/*
+  With EventParanoia, rather than checking modification times we keep track
+  of when we last saw a write event for each file, and a file is ready once
+  it has gone quiet.
+*/
+func (w *Watcher) noteWrite(path string) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.lastWrite == nil {
+		w.lastWrite = make(map[string]time.Time)
+	}
+	w.lastWrite[path] = time.Now()
+}
+
+func (w *Watcher) forgetWrites(path string) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	delete(w.lastWrite, path)
+}
+
+/*
+  How much longer until path has been quiet for the quiet period. A file we
+  haven't seen any writes for (eg one which was there before we started) is
+  treated as written now, so it still gets the full quiet period.
+*/
+func (w *Watcher) quietRemaining(path string) time.Duration {
+	quiet := w.Config.QuietPeriod
+	if quiet <= 0 {
+		quiet = DefaultQuietPeriod
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	last, ok := w.lastWrite[path]
+	if !ok {
+		if w.lastWrite == nil {
+			w.lastWrite = make(map[string]time.Time)
+		}
+		last = time.Now()
+		w.lastWrite[path] = last
+	}
+	return quiet - time.Since(last)
+}
+
+/*
+  Wait for path to go quiet. Each time we wake up it may have been written to
+  again, in which case we go back to sleep for the rest of the new quiet
+  period. Returns false if ctx is done first.
+*/
+func (w *Watcher) waitQuiet(ctx context.Context, path string) bool {
+	for {
+		remaining := w.quietRemaining(path)
+		if remaining <= 0 {
+			return true
+		}
+		w.debug("File written to recently, hang on ", remaining)
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(remaining):
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package watch
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestEventParanoia(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "springboard")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	processed := make(chan time.Time, 1)
+	cfg := Config{
+		dontBlock:   true,
+		Dir:         tempDir,
+		Paranoia:    EventParanoia,
+		QuietPeriod: 300 * time.Millisecond,
+		AfterFileAction: func(file string, result *Result) {
+			processed <- time.Now()
+		},
+	}
+	w, err := NewWatcher(&cfg)
+	if err != nil {
+		panic(err)
+	}
+	if err := w.Run(); err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	f, err := os.Create(tempDir + string(os.PathSeparator) + "foo")
+	if err != nil {
+		panic(err)
+	}
+	var lastWrite time.Time
+	for i := 0; i < 6; i++ {
+		time.Sleep(100 * time.Millisecond)
+		f.Write([]byte("more"))
+		lastWrite = time.Now()
+	}
+	f.Close()
+
+	select {
+	case when := <-processed:
+		if when.Sub(lastWrite) < cfg.QuietPeriod {
+			t.Fatal("processed while still being written to")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("never processed")
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	w.lock.Lock()
+	left := len(w.lastWrite)
+	w.lock.Unlock()
+	makeIs(t)(left, 0, "write times forgotten")
+}
+
+func TestQuietRemaining(t *testing.T) {
+	w := newWatcher(&Config{QuietPeriod: time.Minute})
+	if r := w.quietRemaining("/nowhere"); r <= 59*time.Second {
+		t.Fatal("unseen file should get the full quiet period, got ", r)
+	}
+	w.lastWrite["/nowhere"] = time.Now().Add(-2 * time.Minute)
+	if w.quietRemaining("/nowhere") > 0 {
+		t.Fatal("quiet file should be ready")
+	}
+}
@@ -0,0 +1,99 @@
+package watch
+
+import (
+	"context"
+	"errors"
+	"os"
+	"time"
+)
+
+/* How often StableParanoia looks at a file unless Config.ParanoiaWindow says otherwise */
+const DefaultParanoiaWindow = time.Second
+
+/* How many identical looks StableParanoia needs unless Config.ParanoiaSamples says otherwise */
+const DefaultParanoiaSamples = 3
+
+/* Result.Err for a file which wasn't ready within Config.ParanoiaMaxWait */
+var errNotReady = errors.New("gave up waiting for the file to be finished")
+
+/*
+  Wait until the file at path looks finished, however the paranoia level
+  says to decide that. Returns errInterrupted if we're stopped while
+  waiting, or errNotReady if the file still isn't ready after
+  Config.ParanoiaMaxWait.
+*/
+func (w *Watcher) waitReady(path string) error {
+	ctx := w.ctx
+	if w.Config.ParanoiaMaxWait > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, w.Config.ParanoiaMaxWait)
+		defer cancel()
+	}
+
+	ready := true
+	switch w.Config.Paranoia {
+	case BasicParanoia, ExtraParanoia:
+		for ready && w.paranoiaWait(path) {
+			select {
+			case <-ctx.Done():
+				ready = false
+			case <-time.After(250 * time.Millisecond):
+			}
+		}
+	case EventParanoia:
+		ready = w.waitQuiet(ctx, path)
+	case StableParanoia:
+		ready = w.waitStable(ctx, path)
+	}
+
+	switch {
+	case ready:
+		return nil
+	case w.ctx.Err() != nil:
+		return errInterrupted
+	}
+	return errNotReady
+}
+
+/*
+  Look at the file every Config.ParanoiaWindow until its size and
+  modification time are the same Config.ParanoiaSamples times in a row.
+  Returns false if ctx is done first.
+*/
+func (w *Watcher) waitStable(ctx context.Context, path string) bool {
+	window := w.Config.ParanoiaWindow
+	if window <= 0 {
+		window = DefaultParanoiaWindow
+	}
+	samples := w.Config.ParanoiaSamples
+	if samples <= 0 {
+		samples = DefaultParanoiaSamples
+	}
+
+	var last os.FileInfo
+	same := 0
+	for {
+		fi, err := os.Stat(path)
+		if err != nil {
+			w.error("Could not stat file to determine if it's ready. Going ahead!")
+			return true
+		}
+
+		if last != nil && fi.Size() == last.Size() && fi.ModTime().Equal(last.ModTime()) {
+			same++
+		} else {
+			same = 1
+		}
+		if same >= samples {
+			return true
+		}
+		last = fi
+
+		w.debug("File not settled yet (", same, " of ", samples, "), hang on")
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(window):
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package watch
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+/* Keep appending to path until told to stop */
+func keepWriting(path string, every time.Duration, stop chan bool) {
+	f, err := os.Create(path)
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-time.After(every):
+			f.Write([]byte("more"))
+		}
+	}
+}
+
+func TestStableParanoia(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "springboard")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	processed := make(chan time.Time, 1)
+	cfg := Config{
+		dontBlock:       true,
+		Dir:             tempDir,
+		Paranoia:        StableParanoia,
+		ParanoiaWindow:  50 * time.Millisecond,
+		ParanoiaSamples: 3,
+		AfterFileAction: func(file string, result *Result) {
+			processed <- time.Now()
+		},
+	}
+	w, err := NewWatcher(&cfg)
+	if err != nil {
+		panic(err)
+	}
+	if err := w.Run(); err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	stop := make(chan bool)
+	go keepWriting(tempDir+string(os.PathSeparator)+"foo", 20*time.Millisecond, stop)
+	time.Sleep(300 * time.Millisecond)
+	stop <- true
+	stopped := time.Now()
+
+	select {
+	case when := <-processed:
+		if when.Sub(stopped) < 2*cfg.ParanoiaWindow-10*time.Millisecond {
+			t.Fatal("processed before the size settled")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("never processed")
+	}
+}
+
+func TestParanoiaMaxWait(t *testing.T) {
+	mkTempDir := func() string {
+		s, e := ioutil.TempDir("", "springboard")
+		if e != nil {
+			panic(e)
+		}
+		return s
+	}
+	tempDir := mkTempDir()
+	errDir := mkTempDir()
+	defer os.RemoveAll(tempDir)
+	defer os.RemoveAll(errDir)
+
+	results := make(chan *Result, 1)
+	cfg := Config{
+		dontBlock:       true,
+		Dir:             tempDir,
+		ErrorDir:        errDir,
+		Actions:         []Action{&DummyAction{}},
+		Paranoia:        StableParanoia,
+		ParanoiaWindow:  50 * time.Millisecond,
+		ParanoiaMaxWait: 300 * time.Millisecond,
+		AfterFileAction: func(file string, result *Result) {
+			results <- result
+		},
+	}
+	w, err := NewWatcher(&cfg)
+	if err != nil {
+		panic(err)
+	}
+	if err := w.Run(); err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	stop := make(chan bool)
+	defer close(stop)
+	go keepWriting(tempDir+string(os.PathSeparator)+"foo", 20*time.Millisecond, stop)
+
+	select {
+	case result := <-results:
+		is := makeIs(t)
+		is(result.Outcome, FailureOutcome, "failed")
+		is(result.Err, errNotReady, "because it never settled")
+		makeFileIn(t, "foo")(errDir, true, "sent to the error dir")
+	case <-time.After(2 * time.Second):
+		t.Fatal("waited forever")
+	}
+}
@@ -0,0 +1,118 @@
+package watch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+/*
+  Which files Redrive should have another go at.
+*/
+type RedriveOptions struct {
+	ErrorDir  string        /* Directory to redrive, Config.ErrorDir if not set */
+	Include   []string      /* If set, only redrive files matching one of these patterns (see Config.Include) */
+	OlderThan time.Duration /* Only redrive files last modified at least this long ago */
+}
+
+/*
+  What happened to the files Redrive tried.
+*/
+type RedriveReport struct {
+	Succeeded []string /* Worked, now in the archive dir */
+	Failed    []string /* Failed again, left in the error dir */
+	Skipped   []string /* An action asked for the file to be left alone */
+}
+
+/*
+  Run the actions in c again on the files in an error directory. Files which
+  work are moved to c.ArchiveDir, or their rule's archive directory (keeping
+  any subdirectory), files which fail again are left where they are and, if
+  c.StateDir is set, have their attempt count updated. This doesn't go near
+  the watched directory, but it does need the state directory to itself: with
+  a c.StateDir in use by a running watcher it fails rather than share it.
+*/
+func Redrive(ctx context.Context, c *Config, opts RedriveOptions) (*RedriveReport, error) {
+	errDir := opts.ErrorDir
+	if errDir == "" {
+		errDir = c.ErrorDir
+	}
+	if errDir == "" {
+		return nil, errors.New("no error directory to redrive")
+	}
+	if c.ArchiveDir == "" && len(c.Rules) == 0 {
+		return nil, errors.New("redrive needs an archive directory to put successful files in")
+	}
+
+	filter, err := newFilter(opts.Include, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	w := newWatcher(c)
+	w.ctx, w.cancel = context.WithCancel(ctx)
+	defer w.cancel()
+	if err := w.prepare(); err != nil {
+		return nil, err
+	}
+	defer w.journal.close()
+
+	report := &RedriveReport{}
+	for _, path := range w.filesBelow(errDir) {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+
+		rel, err := filepath.Rel(errDir, path)
+		if err != nil || !filter.wanted(rel) || w.isMarker(path) {
+			continue
+		}
+		fi, err := os.Stat(path)
+		if err != nil || time.Since(fi.ModTime()) < opts.OlderThan {
+			continue
+		}
+
+		w.report_action("Redriving ", path)
+		previous, _ := w.journal.get(path)
+		rt := w.routeFor(path, rel)
+		if rt.archiveDir == "" {
+			w.error("No archive directory for ", path, ", leaving it alone")
+			report.Skipped = append(report.Skipped, path)
+			continue
+		}
+		result := w.actions_for_file(path, rt)
+		result.Attempts = previous.Attempts + 1
+		if result.Ok() {
+			if _, err := moveFile(path, rt.archiveDir, rel); err != nil {
+				/* Still in the error dir, so as far as anyone can tell it failed */
+				result.Outcome, result.Err = FailureOutcome, fmt.Errorf("could not archive: %s", err)
+			}
+		}
+
+		switch result.Outcome {
+		case SuccessOutcome:
+			w.finishMarker(path, rel, rt.archiveDir)
+			w.logJournal(w.journal.remove(path))
+			report.Succeeded = append(report.Succeeded, path)
+		case SkipOutcome:
+			report.Skipped = append(report.Skipped, path)
+		default:
+			w.error("Redriving ", path, " failed after ", result.Attempts, " attempt(s): ", result)
+			w.logJournal(w.journal.put(JournalEntry{
+				Path:      path,
+				State:     FailedState,
+				Attempts:  result.Attempts,
+				LastError: errString(result.Err),
+			}))
+			report.Failed = append(report.Failed, path)
+		}
+
+		if c.AfterFileAction != nil {
+			c.AfterFileAction(path, result)
+		}
+	}
+	return report, nil
+}
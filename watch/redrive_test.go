@@ -0,0 +1,154 @@
+package watch
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestRedrive(t *testing.T) {
+	mkTempDir := func() string {
+		s, e := ioutil.TempDir("", "springboard")
+		if e != nil {
+			panic(e)
+		}
+		return s
+	}
+
+	errDir := mkTempDir()
+	archDir := mkTempDir()
+	stateDir := mkTempDir()
+	defer func() { os.RemoveAll(errDir) }()
+	defer func() { os.RemoveAll(archDir) }()
+	defer func() { os.RemoveAll(stateDir) }()
+
+	sep := string(os.PathSeparator)
+	if err := os.Mkdir(errDir+sep+"acme", 0777); err != nil {
+		panic(err)
+	}
+	old := time.Now().Add(-time.Hour)
+	for _, v := range []string{"good.xml", "acme" + sep + "bad.xml", "other.txt", "new.xml"} {
+		if _, err := os.Create(errDir + sep + v); err != nil {
+			panic(err)
+		}
+		if v != "new.xml" {
+			os.Chtimes(errDir+sep+v, old, old)
+		}
+	}
+
+	j, err := openJournal(stateDir)
+	if err != nil {
+		panic(err)
+	}
+	j.put(JournalEntry{Path: errDir + sep + "acme" + sep + "bad.xml", State: FailedState, Attempts: 3})
+	j.close()
+
+	results := map[string]*Result{}
+	cfg := Config{
+		Debug: true,
+		Actions: []Action{
+			&RunAction{Cmd: "/bin/grep", Args: []string{"-q", "x"}},
+		},
+		AfterFileAction: func(file string, result *Result) {
+			results[file] = result
+		},
+		ArchiveDir: archDir,
+		ErrorDir:   errDir,
+		StateDir:   stateDir,
+	}
+	ioutil.WriteFile(errDir+sep+"good.xml", []byte("x"), 0666)
+	os.Chtimes(errDir+sep+"good.xml", old, old)
+
+	report, err := Redrive(context.Background(), &cfg, RedriveOptions{
+		Include:   []string{"*.xml"},
+		OlderThan: time.Minute,
+	})
+
+	is := makeIs(t)
+	is(err, nil, "redrive ran")
+	is(len(report.Succeeded), 1, "one success")
+	is(report.Succeeded[0], errDir+sep+"good.xml", "good.xml worked")
+	is(len(report.Failed), 1, "one failure")
+	is(report.Failed[0], errDir+sep+"acme"+sep+"bad.xml", "bad.xml failed")
+	is(len(results), 2, "AfterFileAction called for each file")
+
+	makeFileIn(t, "good.xml")(archDir, true, "good.xml archived")
+	makeFileIn(t, "bad.xml")(errDir+sep+"acme", true, "bad.xml left in place")
+	makeFileIn(t, "other.txt")(errDir, true, "filtered file left alone")
+	makeFileIn(t, "new.xml")(errDir, true, "new file left alone")
+
+	j, err = openJournal(stateDir)
+	if err != nil {
+		panic(err)
+	}
+	defer j.close()
+	e, ok := j.get(errDir + sep + "acme" + sep + "bad.xml")
+	is(ok, true, "bad.xml still in the journal")
+	is(e.Attempts, 4, "attempt count updated")
+
+	_, err = Redrive(context.Background(), &Config{ErrorDir: errDir}, RedriveOptions{})
+	if err == nil {
+		t.Fatal("redrive without an archive dir accepted")
+	}
+}
+
+func TestRedriveArchiveFails(t *testing.T) {
+	mkTempDir := func() string {
+		s, e := ioutil.TempDir("", "springboard")
+		if e != nil {
+			panic(e)
+		}
+		return s
+	}
+
+	errDir := mkTempDir()
+	archDir := mkTempDir()
+	stateDir := mkTempDir()
+	defer func() { os.RemoveAll(errDir) }()
+	defer func() { os.RemoveAll(archDir) }()
+	defer func() { os.RemoveAll(stateDir) }()
+
+	/* A file where the archive wants a directory, so archiving fails */
+	sep := string(os.PathSeparator)
+	stuck := errDir + sep + "acme" + sep + "stuck.xml"
+	os.Mkdir(errDir+sep+"acme", 0777)
+	ioutil.WriteFile(stuck, []byte("x"), 0666)
+	ioutil.WriteFile(archDir+sep+"acme", []byte("in the way"), 0666)
+
+	j, err := openJournal(stateDir)
+	if err != nil {
+		panic(err)
+	}
+	j.put(JournalEntry{Path: stuck, State: FailedState, Attempts: 1})
+
+	cfg := Config{
+		Actions:    []Action{&EchoAction{}},
+		ArchiveDir: archDir,
+		ErrorDir:   errDir,
+		StateDir:   stateDir,
+	}
+
+	is := makeIs(t)
+	_, err = Redrive(context.Background(), &cfg, RedriveOptions{})
+	if err == nil {
+		t.Fatal("redrive shared the state directory with a running watcher")
+	}
+	j.close()
+
+	report, err := Redrive(context.Background(), &cfg, RedriveOptions{})
+	is(err, nil, "redrive ran")
+	is(len(report.Succeeded), 0, "nothing archived")
+	is(len(report.Failed), 1, "reported as failed")
+	makeFileIn(t, "stuck.xml")(errDir+sep+"acme", true, "left in the error dir")
+
+	j, err = openJournal(stateDir)
+	if err != nil {
+		panic(err)
+	}
+	defer j.close()
+	e, ok := j.get(stuck)
+	is(ok, true, "still in the journal")
+	is(e.Attempts, 2, "attempt count updated")
+}
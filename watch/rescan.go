@@ -0,0 +1,84 @@
+package watch
+
+import (
+	"os"
+	"time"
+)
+
+/* How old a file has to be for a rescan to pick it up, unless Config.RescanAge says otherwise */
+const DefaultRescanAge = time.Minute
+
+/*
+  With Config.RescanInterval we don't rely on events alone: every so often
+  we list the directory again and queue anything we've never picked up.
+  Files are only rescued once they haven't been touched for Config.RescanAge,
+  so files whose events are merely on their way (or which are still being
+  written) are left to the usual route. Files go through the same queue as
+  everything else, so one which has been picked up already is never
+  processed again.
+*/
+func (w *Watcher) rescanLoop() {
+	ticker := time.NewTicker(w.Config.RescanInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.stopping:
+			return
+		case <-ticker.C:
+			w.rescan()
+		}
+	}
+}
+
+func (w *Watcher) rescan() {
+	paths, err := w.existingFiles()
+	if err != nil {
+		w.error("Could not rescan ", w.Config.Dir, ": ", err)
+		return
+	}
+
+	age := w.Config.RescanAge
+	if age <= 0 {
+		age = DefaultRescanAge
+	}
+
+	for _, path := range paths {
+		if w.wasSeen(path) || w.wasIgnored(path) {
+			continue
+		}
+		fi, err := os.Stat(path)
+		if err != nil || fi.IsDir() || time.Since(fi.ModTime()) < age {
+			continue
+		}
+		w.report_action("Rescan found missed file ", path)
+		if !w.enqueue(path) {
+			return
+		}
+	}
+}
+
+/*
+  Without Config.ProcessExistingFiles the files already there when we start
+  aren't ours to process, make sure rescans don't mistake them for files
+  we've missed.
+*/
+func (w *Watcher) ignoreExisting() {
+	paths, err := w.existingFiles()
+	if err != nil {
+		/* Watching the directory will fail too, and say why */
+		return
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	for _, path := range paths {
+		w.ignored[path] = true
+	}
+}
+
+func (w *Watcher) wasIgnored(path string) bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.ignored[path]
+}
@@ -0,0 +1,81 @@
+package watch
+
+import (
+	"gopkg.in/fsnotify.v1"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+/* A backend which never tells us anything, as if every event was lost */
+type deafBackend struct {
+	events chan fsnotify.Event
+	errors chan error
+}
+
+func (b *deafBackend) Add(dir string) error          { return nil }
+func (b *deafBackend) Remove(dir string) error       { return nil }
+func (b *deafBackend) Events() <-chan fsnotify.Event { return b.events }
+func (b *deafBackend) Errors() <-chan error          { return b.errors }
+func (b *deafBackend) Close() error {
+	close(b.events)
+	close(b.errors)
+	return nil
+}
+
+func TestRescan(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "springboard")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tempDir)
+	sep := string(os.PathSeparator)
+	ioutil.WriteFile(tempDir+sep+"before", []byte("before"), 0666)
+
+	processed := make(chan string, 10)
+	cfg := Config{
+		dontBlock:      true,
+		Dir:            tempDir,
+		RescanInterval: 20 * time.Millisecond,
+		RescanAge:      300 * time.Millisecond,
+		AfterFileAction: func(file string, result *Result) {
+			processed <- file
+		},
+	}
+	w := newWatcher(&cfg)
+	w.backend = &deafBackend{make(chan fsnotify.Event), make(chan error)}
+	if err := w.Run(); err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	old := time.Now().Add(-time.Hour)
+	ioutil.WriteFile(tempDir+sep+"missed", []byte("missed"), 0666)
+	os.Chtimes(tempDir+sep+"missed", old, old)
+	ioutil.WriteFile(tempDir+sep+"young", []byte("young"), 0666)
+	written := time.Now()
+
+	is := makeIs(t)
+	next := func() string {
+		select {
+		case file := <-processed:
+			return file
+		case <-time.After(time.Second):
+			return ""
+		}
+	}
+	is(next(), tempDir+sep+"missed", "missed file picked up")
+	is(next(), tempDir+sep+"young", "young file picked up")
+	if time.Since(written) < cfg.RescanAge {
+		t.Fatal("young file picked up too soon")
+	}
+
+	/* Still there (no archive), but never processed twice. And files there
+	   before we started are left alone without ProcessExistingFiles */
+	select {
+	case file := <-processed:
+		t.Fatal("unexpected ", file)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
@@ -0,0 +1,88 @@
+package watch
+
+import "fmt"
+
+/*
+   What happened when an action processed a file, which decides what happens
+   to the file next.
+*/
+type Outcome int
+
+const (
+	SuccessOutcome Outcome = 0 + iota /* Worked, file goes to the archive */
+	FailureOutcome                    /* Failed & no point trying again, file goes to the error dir */
+	RetryOutcome                      /* Failed but might work later, eg the server was down */
+	SkipOutcome                       /* Not for us, leave the file where it is */
+)
+
+func (o Outcome) String() string {
+	switch o {
+	case SuccessOutcome:
+		return "success"
+	case FailureOutcome:
+		return "failure"
+	case RetryOutcome:
+		return "retryable failure"
+	case SkipOutcome:
+		return "skipped"
+	}
+	return fmt.Sprintf("Outcome(%d)", int(o))
+}
+
+/*
+   The result of processing a file: the outcome, why it failed (if it did) and
+   any details worth reporting such as the HTTP status or exit code.
+*/
+type Result struct {
+	Outcome  Outcome
+	Err      error
+	Meta     map[string]string
+	Attempts int /* How many times the actions have been run on the file, filled in by the watcher */
+}
+
+func NewResult(o Outcome, err error) *Result {
+	return &Result{Outcome: o, Err: err, Meta: make(map[string]string)}
+}
+
+/* Shorthand for a successful result */
+func Succeeded() *Result {
+	return NewResult(SuccessOutcome, nil)
+}
+
+/* Shorthand for a permanent failure */
+func Failed(err error) *Result {
+	return NewResult(FailureOutcome, err)
+}
+
+/* Shorthand for a failure worth retrying */
+func Retryable(err error) *Result {
+	return NewResult(RetryOutcome, err)
+}
+
+/* Shorthand for a file the action wants left alone */
+func Skipped(reason error) *Result {
+	return NewResult(SkipOutcome, reason)
+}
+
+/*
+   Record a detail about the result, eg Set("http_status", 200). Returns the
+   result so calls can be chained.
+*/
+func (r *Result) Set(key string, val interface{}) *Result {
+	if r.Meta == nil {
+		r.Meta = make(map[string]string)
+	}
+	r.Meta[key] = fmt.Sprint(val)
+	return r
+}
+
+func (r *Result) Ok() bool {
+	return r.Outcome == SuccessOutcome
+}
+
+func (r *Result) String() string {
+	if r.Err != nil {
+		return fmt.Sprintf("%s: %s", r.Outcome, r.Err)
+	}
+	return r.Outcome.String()
+}
@@ -0,0 +1,144 @@
+package watch
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+)
+
+/* An old style action */
+type boolTestAction struct {
+	ok bool
+}
+
+func (a *boolTestAction) Process(w *Watcher, file string) bool {
+	return a.ok
+}
+
+/* A context action which fails with err */
+type errTestAction struct {
+	err error
+}
+
+func (a *errTestAction) Process(ctx context.Context, w *Watcher, file string) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return a.err
+}
+
+func TestActionKinds(t *testing.T) {
+	is := makeIs(t)
+	ctx := context.Background()
+	process := func(a Action, ctx context.Context) *Result {
+		ra, err := resultActionFor(a)
+		is(err, nil, "adapted")
+		return ra.Process(ctx, nil, "x")
+	}
+
+	is(process(&boolTestAction{true}, ctx).Outcome, SuccessOutcome, "bool true is success")
+	is(process(&boolTestAction{false}, ctx).Outcome, FailureOutcome, "bool false is a failure")
+	is(process(&errTestAction{nil}, ctx).Outcome, SuccessOutcome, "nil error is success")
+	is(process(&errTestAction{errors.New("boom")}, ctx).Outcome, FailureOutcome, "error is a failure")
+	is(process(&DummyAction{}, ctx).Outcome, SuccessOutcome, "result action used as it is")
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	is(process(&errTestAction{nil}, cancelled).Outcome, RetryOutcome, "cancelled context action can be retried")
+	block := &blockingAction{started: make(chan string, 1), release: make(chan bool)}
+	defer close(block.release)
+	r := process(block, cancelled)
+	is(r.Err, context.Canceled, "cancelled bool action given up on")
+
+	if _, err := resultActionFor("echo"); err == nil {
+		t.Fatal("a string is an action")
+	}
+}
+
+func TestResult(t *testing.T) {
+	is := makeIs(t)
+	r := Failed(errors.New("boom")).Set("http_status", 404)
+	is(r.Ok(), false, "failure isn't ok")
+	is(r.Meta["http_status"], "404", "meta stored as a string")
+	is(r.String(), "failure: boom", "string form")
+	is(Succeeded().Ok(), true, "success is ok")
+	is(SkipOutcome.String(), "skipped", "outcome string")
+}
+
+/* An action which always gives the same result, until it's told otherwise */
+type resultAction struct {
+	lock   sync.Mutex
+	result *Result
+}
+
+func (a *resultAction) set(result *Result) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.result = result
+}
+
+func (a *resultAction) Process(ctx context.Context, w *Watcher, file string) *Result {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.result
+}
+
+func TestOutcomes(t *testing.T) {
+	mkTempDir := func() string {
+		s, e := ioutil.TempDir("", "springboard")
+		if e != nil {
+			panic(e)
+		}
+		return s
+	}
+
+	tempDir := mkTempDir()
+	archDir := mkTempDir()
+	errDir := mkTempDir()
+
+	defer func() { os.RemoveAll(tempDir) }()
+	defer func() { os.RemoveAll(archDir) }()
+	defer func() { os.RemoveAll(errDir) }()
+
+	action := resultAction{}
+	wait := make(chan *Result)
+	cfg := Config{
+		dontBlock: true,
+		Dir:       tempDir,
+		Debug:     true,
+		Actions:   []Action{&DummyAction{}, &action},
+		AfterFileAction: func(file string, result *Result) {
+			wait <- result
+		},
+		ArchiveDir: archDir,
+		ErrorDir:   errDir,
+		Workers:    1,
+	}
+
+	Watch(&cfg)
+
+	is := makeIs(t)
+	for _, c := range []struct {
+		name   string
+		result *Result
+		dir    string
+	}{
+		{"ok", Succeeded().Set("thing", 1), archDir},
+		{"failed", Failed(errors.New("bad file")), errDir},
+		{"retry", Retryable(errors.New("try later")), errDir},
+		{"skip", Skipped(errors.New("not mine")), tempDir},
+	} {
+		action.set(c.result)
+		_, err := os.Create(tempDir + string(os.PathSeparator) + c.name)
+		if err != nil {
+			panic(err)
+		}
+		got := <-wait
+		is(got.Outcome, c.result.Outcome, c.name+" outcome passed on")
+		is(got.Err, c.result.Err, c.name+" error passed on")
+		makeFileIn(t, c.name)(c.dir, true, c.name+" ended up in the right place")
+	}
+}
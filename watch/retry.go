@@ -0,0 +1,210 @@
+package watch
+
+import (
+	"errors"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+/* Defaults for the parts of a RetryPolicy left unset */
+const (
+	DefaultRetryDelay      = time.Second
+	DefaultRetryMultiplier = 2.0
+	DefaultRetryMaxDelay   = 5 * time.Minute
+)
+
+/*
+  How we retry files whose actions fail in a way worth retrying (see
+  RetryOutcome). After each failed attempt we wait, starting at InitialDelay and
+  multiplying the wait by Multiplier each time, up to MaxDelay. Jitter (0-1)
+  randomly varies each wait by up to that fraction, so a pile of files which
+  failed together don't all retry at exactly the same moment.
+*/
+type RetryPolicy struct {
+	MaxAttempts  int           /* Attempts in total including the first, 0 or 1 means don't retry */
+	InitialDelay time.Duration /* Wait before the first retry, DefaultRetryDelay if not set */
+	Multiplier   float64       /* Growth of the wait per attempt, DefaultRetryMultiplier if not set */
+	MaxDelay     time.Duration /* Longest wait, DefaultRetryMaxDelay if not set */
+	Jitter       float64       /* Fraction to randomly vary waits by */
+}
+
+func (p *RetryPolicy) attempts() int {
+	if p.MaxAttempts < 1 {
+		return 1
+	}
+	return p.MaxAttempts
+}
+
+/*
+  How long to wait after attempt number attempt (counting from 1) fails.
+*/
+func (p *RetryPolicy) delay(attempt int) time.Duration {
+	initial, multiplier, max := p.InitialDelay, p.Multiplier, p.MaxDelay
+	if initial <= 0 {
+		initial = DefaultRetryDelay
+	}
+	if multiplier < 1 {
+		multiplier = DefaultRetryMultiplier
+	}
+	if max <= 0 {
+		max = DefaultRetryMaxDelay
+	}
+
+	d := float64(initial)
+	for i := 1; i < attempt && d < float64(max); i++ {
+		d *= multiplier
+	}
+	if d > float64(max) {
+		d = float64(max)
+	}
+
+	if p.Jitter > 0 {
+		d += d * p.Jitter * (rand.Float64()*2 - 1)
+	}
+	return time.Duration(d)
+}
+
+/* Result.Err when we stop retrying a file because we're shutting down */
+var errInterrupted = errors.New("shutting down, leaving the file for next time")
+
+/*
+  A file waiting for its next attempt. We keep track of the attempts here as
+  well as in the journal, so retries work without a Config.StateDir.
+*/
+type pendingRetry struct {
+	attempts int
+	due      time.Time
+	timer    *time.Timer /* nil once it's gone off */
+}
+
+/*
+  Run the route's actions for a file, as one of the attempts Config.Retry
+  allows. Attempts made before a restart (see Config.StateDir) count towards
+  the total, but we always make at least one. If the result is retryable and
+  there are attempts left the file is scheduled to go back on the queue once
+  the retry is due, and we return nil so the worker can get on with other
+  files meanwhile.
+*/
+func (w *Watcher) actions_with_retries(path string, rt *route) *Result {
+	policy := &w.Config.Retry
+	attempts := policy.attempts()
+	previous, due := w.retryState(path)
+
+	if time.Until(due) > 0 {
+		/* Turned up again before it's due, eg it was rewritten, wait our turn */
+		w.retryAt(path, previous, due)
+		return nil
+	}
+
+	attempt := previous + 1
+	if attempt > 1 {
+		w.report_action("Attempt ", attempt, " of ", attempts, " for ", path)
+	}
+	result := w.actions_for_file(path, rt)
+	result.Attempts = attempt
+
+	if w.ctx.Err() != nil && !result.Ok() {
+		/* We were cancelled, that's not the file's fault */
+		w.forgetRetry(path)
+		return Skipped(errInterrupted)
+	}
+	if result.Outcome != RetryOutcome || attempt >= attempts {
+		w.forgetRetry(path)
+		return result
+	}
+
+	wait := policy.delay(attempt)
+	due = time.Now().Add(wait)
+	w.error("Attempt ", attempt, " of ", attempts, " for ", path, " failed: ", result, " retrying in ", wait)
+	w.logJournal(w.journal.put(JournalEntry{
+		Path:        path,
+		State:       PendingState,
+		Attempts:    attempt,
+		NextAttempt: due,
+		LastError:   errString(result.Err),
+	}))
+
+	select {
+	case <-w.stopping:
+		/* The journal knows when it's due, leave it for next time */
+		w.forgetRetry(path)
+		return Skipped(errInterrupted)
+	default:
+	}
+	w.retryAt(path, attempt, due)
+	return nil
+}
+
+/*
+  How many attempts path has had and when it's due another go, from the
+  retry we have scheduled if there is one, otherwise from the journal.
+*/
+func (w *Watcher) retryState(path string) (attempts int, due time.Time) {
+	w.lock.Lock()
+	r, ok := w.retries[path]
+	w.lock.Unlock()
+	if ok {
+		return r.attempts, r.due
+	}
+	e, _ := w.journal.get(path)
+	return e.Attempts, e.NextAttempt
+}
+
+/*
+  Put path back on the queue at due. Scheduling a file which is already
+  waiting leaves the existing timer be.
+*/
+func (w *Watcher) retryAt(path string, attempts int, due time.Time) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if r, ok := w.retries[path]; ok && r.timer != nil {
+		return
+	}
+	r := &pendingRetry{attempts: attempts, due: due}
+	r.timer = time.AfterFunc(time.Until(due), func() {
+		w.lock.Lock()
+		if w.retries[path] != r || r.timer == nil {
+			/* Cancelled */
+			w.lock.Unlock()
+			return
+		}
+		r.timer = nil
+		w.lock.Unlock()
+		w.enqueue(path)
+	})
+	w.retries[path] = r
+}
+
+func (w *Watcher) forgetRetry(path string) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	delete(w.retries, path)
+}
+
+/*
+  Cancel the retries which haven't come round yet, returning the files
+  concerned. The journal still has them.
+*/
+func (w *Watcher) cancelRetries() (files []string) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	for path, r := range w.retries {
+		if r.timer != nil && r.timer.Stop() {
+			files = append(files, path)
+		}
+		r.timer = nil
+	}
+	w.retries = make(map[string]*pendingRetry)
+	sort.Strings(files)
+	return
+}
+
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
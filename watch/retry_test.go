@@ -0,0 +1,198 @@
+package watch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRetryDelay(t *testing.T) {
+	is := makeIs(t)
+
+	var p RetryPolicy
+	is(p.attempts(), 1, "no retries by default")
+	is(p.delay(1), DefaultRetryDelay, "default delay")
+	is(p.delay(2), 2*DefaultRetryDelay, "default multiplier")
+	is(p.delay(100), DefaultRetryMaxDelay, "default max delay")
+
+	p = RetryPolicy{MaxAttempts: 5, InitialDelay: 100 * time.Millisecond, Multiplier: 3, MaxDelay: time.Second}
+	is(p.attempts(), 5, "attempts")
+	is(p.delay(1), 100*time.Millisecond, "first delay")
+	is(p.delay(2), 300*time.Millisecond, "second delay")
+	is(p.delay(3), 900*time.Millisecond, "third delay")
+	is(p.delay(4), time.Second, "capped delay")
+
+	p.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		d := p.delay(1)
+		if d < 50*time.Millisecond || d > 150*time.Millisecond {
+			t.Fatal("jitter out of range ", d)
+		}
+	}
+}
+
+/* Fails (retryably) a set number of times and then works */
+type flakyAction struct {
+	lock     sync.Mutex
+	failures int
+	calls    int
+}
+
+func (a *flakyAction) Process(ctx context.Context, w *Watcher, file string) *Result {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.calls++
+	if a.calls <= a.failures {
+		return Retryable(errors.New("not yet"))
+	}
+	return Succeeded()
+}
+
+/* Start counting again, failing the next failures calls */
+func (a *flakyAction) reset(failures int) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.calls = 0
+	a.failures = failures
+}
+
+func (a *flakyAction) count() int {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.calls
+}
+
+func TestRetry(t *testing.T) {
+	mkTempDir := func() string {
+		s, e := ioutil.TempDir("", "springboard")
+		if e != nil {
+			panic(e)
+		}
+		return s
+	}
+
+	tempDir := mkTempDir()
+	archDir := mkTempDir()
+	errDir := mkTempDir()
+
+	defer func() { os.RemoveAll(tempDir) }()
+	defer func() { os.RemoveAll(archDir) }()
+	defer func() { os.RemoveAll(errDir) }()
+
+	action := flakyAction{failures: 2}
+	wait := make(chan *Result)
+	cfg := Config{
+		dontBlock: true,
+		Dir:       tempDir,
+		Debug:     true,
+		Actions:   []Action{&action},
+		AfterFileAction: func(file string, result *Result) {
+			wait <- result
+		},
+		ArchiveDir: archDir,
+		ErrorDir:   errDir,
+		Workers:    1,
+		Retry: RetryPolicy{
+			MaxAttempts:  3,
+			InitialDelay: 10 * time.Millisecond,
+		},
+	}
+
+	Watch(&cfg)
+
+	is := makeIs(t)
+	_, err := os.Create(tempDir + string(os.PathSeparator) + "foo")
+	if err != nil {
+		panic(err)
+	}
+	result := <-wait
+	is(result.Ok(), true, "worked on the third attempt")
+	is(result.Attempts, 3, "attempts recorded")
+	makeFileIn(t, "foo")(archDir, true, "foo archived")
+
+	action.reset(3)
+	_, err = os.Create(tempDir + string(os.PathSeparator) + "bar")
+	if err != nil {
+		panic(err)
+	}
+	result = <-wait
+	is(result.Outcome, RetryOutcome, "gave up")
+	is(action.count(), 3, "tried 3 times")
+	makeFileIn(t, "bar")(errDir, true, "bar in the error dir")
+}
+
+/* Fails the first attempt at each file, telling us about every attempt */
+type firstTimeAction struct {
+	lock  sync.Mutex
+	tried map[string]bool
+	calls chan string
+}
+
+func (a *firstTimeAction) Process(ctx context.Context, w *Watcher, file string) *Result {
+	a.lock.Lock()
+	again := a.tried[file]
+	a.tried[file] = true
+	a.lock.Unlock()
+
+	a.calls <- filepath.Base(file)
+	if !again {
+		return Retryable(errors.New("first time"))
+	}
+	return Succeeded()
+}
+
+func TestRetryFreesWorker(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "springboard")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tempDir)
+	sep := string(os.PathSeparator)
+
+	action := firstTimeAction{tried: make(map[string]bool), calls: make(chan string, 10)}
+	results := make(chan string, 10)
+	cfg := Config{
+		dontBlock: true,
+		Dir:       tempDir,
+		StateDir:  tempDir + sep + ".state",
+		Actions:   []Action{&action},
+		AfterFileAction: func(file string, result *Result) {
+			results <- fmt.Sprint(filepath.Base(file), " ", result.Outcome, " ", result.Attempts)
+		},
+		Workers: 1,
+		Retry: RetryPolicy{
+			MaxAttempts:  2,
+			InitialDelay: 300 * time.Millisecond,
+		},
+	}
+	w, err := NewWatcher(&cfg)
+	if err != nil {
+		panic(err)
+	}
+	w.Run()
+
+	is := makeIs(t)
+	ioutil.WriteFile(tempDir+sep+"foo", []byte("foo"), 0666)
+	is(<-action.calls, "foo", "foo tried")
+	time.Sleep(100 * time.Millisecond)
+	ioutil.WriteFile(tempDir+sep+"bar", []byte("bar"), 0666)
+	is(<-action.calls, "bar", "bar tried while foo waits for its retry")
+	is(<-action.calls, "foo", "foo retried")
+	is(<-results, "foo success 2", "foo done")
+	is(<-action.calls, "bar", "bar retried")
+	is(<-results, "bar success 2", "bar done")
+
+	ioutil.WriteFile(tempDir+sep+"baz", []byte("baz"), 0666)
+	is(<-action.calls, "baz", "baz tried")
+	unprocessed, err := w.Shutdown(context.Background())
+	is(err, nil, "shutdown didn't wait for the retry")
+	is(len(unprocessed), 1, "one file unprocessed")
+	is(unprocessed[0], tempDir+sep+"baz", "the file waiting to be retried is unprocessed")
+	makeFileIn(t, "baz")(tempDir, true, "baz left in place")
+}
@@ -0,0 +1,228 @@
+package watch
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+/*
+  A routing rule: which files it applies to, and what to do with them. Rules
+  are tried in order and the first one matching a file decides its fate.
+  Every matcher which is set has to match, a rule without any matches
+  everything. A rule without actions rejects the files it matches, sending
+  them straight to the error directory.
+*/
+type Rule struct {
+	Name       string   /* Used in logs and as the "rule" in a Result's Meta */
+	Match      []string /* Globs or re:REGEX patterns as Config.Include, any can match */
+	Extensions []string /* Filename extensions, eg ".xml", any can match, ignoring case */
+	MinSize    int64    /* Smallest file (in bytes) the rule applies to */
+	MaxSize    int64    /* Largest file the rule applies to, if set */
+	Mime       []string /* Types (eg application/pdf, or image/*) from sniffing the content, any can match */
+	Actions    []Action /* What to do with matching files */
+	ArchiveDir string   /* Where successful files go, Config.ArchiveDir if not set */
+	ErrorDir   string   /* Where failed files go, Config.ErrorDir if not set */
+}
+
+/* Result.Err for files no rule wanted, when there are no default actions */
+var errNoRule = errors.New("no rule matches the file")
+
+/*
+  Where a file goes: the actions to run and where to put it afterwards.
+  Files not matching any rule take the default route, Config.Actions.
+*/
+type route struct {
+	name       string
+	actions    []ResultAction
+	archiveDir string
+	errorDir   string
+	reject     error /* If set fail the file with this, without running anything */
+
+	rule  *Rule /* nil for the default route */
+	match *filter
+	exts  []string
+}
+
+/*
+  Build the routes for Config.Rules, plus the default route.
+*/
+func (w *Watcher) prepareRoutes() error {
+	c := w.Config
+	w.routes = nil
+	for i := range c.Rules {
+		r := &c.Rules[i]
+		name := r.Name
+		if name == "" {
+			name = fmt.Sprint("#", i+1)
+		}
+		rt, err := newRoute(name, r, c)
+		if err != nil {
+			return fmt.Errorf("rule %s: %s", name, err)
+		}
+		w.routes = append(w.routes, rt)
+	}
+
+	w.defaultRoute = &route{archiveDir: c.ArchiveDir, errorDir: c.ErrorDir}
+	actions, err := resultActions(c.Actions)
+	if err != nil {
+		return err
+	}
+	w.defaultRoute.actions = actions
+	if len(c.Rules) > 0 && len(c.Actions) == 0 {
+		w.defaultRoute.reject = errNoRule
+	}
+	return nil
+}
+
+func newRoute(name string, r *Rule, c *Config) (*route, error) {
+	match, err := newFilter(r.Match, nil)
+	if err != nil {
+		return nil, err
+	}
+	if r.MaxSize > 0 && r.MaxSize < r.MinSize {
+		return nil, fmt.Errorf("max size is less than min size")
+	}
+
+	rt := &route{
+		name:       name,
+		rule:       r,
+		archiveDir: r.ArchiveDir,
+		errorDir:   r.ErrorDir,
+		match:      match,
+	}
+	if rt.archiveDir == "" {
+		rt.archiveDir = c.ArchiveDir
+	}
+	if rt.errorDir == "" {
+		rt.errorDir = c.ErrorDir
+	}
+	for _, ext := range r.Extensions {
+		rt.exts = append(rt.exts, "."+strings.ToLower(strings.TrimPrefix(ext, ".")))
+	}
+	if rt.actions, err = resultActions(r.Actions); err != nil {
+		return nil, err
+	}
+	if len(rt.actions) == 0 {
+		rt.reject = fmt.Errorf("rejected by rule %s", name)
+	}
+	return rt, nil
+}
+
+/* The actions, adapted to ResultActions, or why one of them won't do */
+func resultActions(actions []Action) ([]ResultAction, error) {
+	adapted := make([]ResultAction, len(actions))
+	for i, a := range actions {
+		if a == nil {
+			return nil, fmt.Errorf("action %d is missing", i+1)
+		}
+		ra, err := resultActionFor(a)
+		if err != nil {
+			return nil, fmt.Errorf("action %d: %s", i+1, err)
+		}
+		adapted[i] = ra
+	}
+	return adapted, nil
+}
+
+/*
+  The route for the file at file, rel being where it is relative to the
+  watched directory.
+*/
+func (w *Watcher) routeFor(file, rel string) *route {
+	for _, rt := range w.routes {
+		if rt.matches(file, rel) {
+			w.debug("Rule ", rt.name, " matches ", file)
+			return rt
+		}
+	}
+	return w.defaultRoute
+}
+
+func (rt *route) matches(file, rel string) bool {
+	r := rt.rule
+	if len(r.Match) > 0 && !rt.match.wanted(rel) {
+		return false
+	}
+
+	if len(rt.exts) > 0 {
+		ext := strings.ToLower(path.Ext(filepath.ToSlash(rel)))
+		found := false
+		for _, e := range rt.exts {
+			found = found || e == ext
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if r.MinSize > 0 || r.MaxSize > 0 {
+		fi, err := os.Stat(file)
+		if err != nil {
+			return false
+		}
+		if fi.Size() < r.MinSize || (r.MaxSize > 0 && fi.Size() > r.MaxSize) {
+			return false
+		}
+	}
+
+	if len(r.Mime) > 0 {
+		sniffed, err := sniffMime(file)
+		if err != nil {
+			return false
+		}
+		found := false
+		for _, m := range r.Mime {
+			found = found || mimeMatches(m, sniffed)
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+  The type of the file going by its first 512 bytes, without any parameters
+  (so text/plain rather than text/plain; charset=utf-8).
+*/
+func sniffMime(file string) (string, error) {
+	sniffed, err := sniffContentType(file)
+	if err != nil {
+		return "", err
+	}
+	if i := strings.Index(sniffed, ";"); i >= 0 {
+		sniffed = sniffed[:i]
+	}
+	return sniffed, nil
+}
+
+/* As sniffMime, but with any parameters */
+func sniffContentType(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	buf := make([]byte, 512)
+	n, err := io.ReadFull(f, buf)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	return http.DetectContentType(buf[:n]), nil
+}
+
+/* Does want (eg image/png or image/*) match the type we have? */
+func mimeMatches(want, have string) bool {
+	want = strings.ToLower(strings.TrimSpace(want))
+	if strings.HasSuffix(want, "/*") {
+		return strings.HasPrefix(have, strings.TrimSuffix(want, "*"))
+	}
+	return want == have
+}
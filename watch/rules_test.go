@@ -0,0 +1,111 @@
+package watch
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRules(t *testing.T) {
+	mkTempDir := func() string {
+		s, e := ioutil.TempDir("", "springboard")
+		if e != nil {
+			panic(e)
+		}
+		return s
+	}
+	sep := string(os.PathSeparator)
+
+	tempDir, orders, print, big, errDir := mkTempDir(), mkTempDir(), mkTempDir(), mkTempDir(), mkTempDir()
+	for _, d := range []string{tempDir, orders, print, big, errDir} {
+		defer os.RemoveAll(d)
+	}
+
+	files := map[string]string{
+		"order.XML":   "<order/>",
+		"big.xml":     strings.Repeat("x", 100),
+		"doc.pdf":     "%PDF-1.4 ...",
+		"fake.pdf":    "not really",
+		"notes.txt":   "hello",
+		"reject.junk": "nope",
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(tempDir+sep+name, []byte(content), 0666); err != nil {
+			panic(err)
+		}
+	}
+
+	wait := make(chan [2]string)
+	cfg := Config{
+		dontBlock:            true,
+		Dir:                  tempDir,
+		ProcessExistingFiles: true,
+		ErrorDir:             errDir,
+		Rules: []Rule{
+			{Name: "junk", Extensions: []string{"junk"}},
+			{Name: "big", MinSize: 50, ArchiveDir: big, Actions: []Action{&EchoAction{}}},
+			{Name: "orders", Extensions: []string{".xml"}, ArchiveDir: orders, Actions: []Action{&EchoAction{}}},
+			{Name: "print", Match: []string{"*.pdf"}, Mime: []string{"application/pdf"}, ArchiveDir: print, Actions: []Action{&EchoAction{}}},
+		},
+		AfterFileAction: func(file string, result *Result) {
+			_, name := filepath.Split(file)
+			wait <- [2]string{name, result.Meta["rule"]}
+		},
+	}
+
+	w, err := NewWatcher(&cfg)
+	if err != nil {
+		panic(err)
+	}
+	if err := w.Run(); err != nil {
+		t.Fatal(err)
+	}
+	rules := map[string]string{}
+	for range files {
+		got := <-wait
+		rules[got[0]] = got[1]
+	}
+	w.Close()
+
+	is := makeIs(t)
+	makeFileIn(t, "order.XML")(orders, true, "xml goes to orders, ignoring case")
+	makeFileIn(t, "big.xml")(big, true, "earlier rule wins")
+	makeFileIn(t, "doc.pdf")(print, true, "pdf goes to print")
+	makeFileIn(t, "fake.pdf")(errDir, true, "not really a pdf, no rule")
+	makeFileIn(t, "notes.txt")(errDir, true, "no rule and no default actions")
+	makeFileIn(t, "reject.junk")(errDir, true, "rule without actions rejects")
+	is(rules["doc.pdf"], "print", "rule recorded in the result")
+	is(rules["notes.txt"], "", "no rule recorded without a match")
+}
+
+func TestRuleDefault(t *testing.T) {
+	is := makeIs(t)
+	cfg := Config{
+		Actions: []Action{&EchoAction{}},
+		Rules:   []Rule{{Name: "xml", Match: []string{"*.xml"}, Actions: []Action{&EchoAction{}}}},
+	}
+	w := newWatcher(&cfg)
+	is(w.prepareRoutes(), nil, "prepared")
+	is(w.routeFor("/nowhere/a.xml", "a.xml").name, "xml", "rule")
+	is(w.routeFor("/nowhere/a.txt", "a.txt"), w.defaultRoute, "default")
+	is(w.defaultRoute.reject, nil, "default actions used")
+
+	cfg.Rules = []Rule{{Name: "sizes", MinSize: 10, MaxSize: 5}}
+	if w.prepareRoutes() == nil {
+		t.Fatal("bad size range accepted")
+	}
+	cfg.Rules = []Rule{{Match: []string{"re:("}}}
+	if cfg.Validate() == nil {
+		t.Fatal("bad rule pattern accepted")
+	}
+}
+
+func TestMimeMatches(t *testing.T) {
+	is := makeIs(t)
+	is(mimeMatches("image/*", "image/png"), true, "wildcard")
+	is(mimeMatches("Application/PDF", "application/pdf"), true, "case")
+	is(mimeMatches("image/*", "text/plain"), false, "wildcard mismatch")
+	is(mimeMatches("text/xml", "text/plain"), false, "mismatch")
+}
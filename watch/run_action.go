@@ -1,34 +1,53 @@
 package watch
 
 import (
+	"context"
+	"fmt"
 	"os/exec"
 )
 
 type RunAction struct {
-	Cmd      string
-	Args     []string
-	PostArgs []string
+	Cmd            string
+	Args           []string
+	PostArgs       []string
+	RetryExitCodes []int /* Exit codes which mean try again later (see Config.Retry), any other failure is permanent */
 }
 
-func (a *RunAction) Process(w *Watcher, file string) bool {
-	w.report_action("Attempting to run ", a.Cmd, " on ", file )
+func (a *RunAction) Process(ctx context.Context, w *Watcher, file string) *Result {
+	w.report_action("Attempting to run ", a.Cmd, " on ", file)
 
-	final_args := a.Args
+	var final_args []string
+	final_args = append(final_args, a.Args...)
 	final_args = append(final_args, file)
 	final_args = append(final_args, a.PostArgs...)
-	cm := exec.Command(a.Cmd, final_args...)
+	cm := exec.CommandContext(ctx, a.Cmd, final_args...)
 
 	rerr := cm.Run()
 
 	if rerr != nil {
+		if ctx.Err() != nil {
+			return Retryable(fmt.Errorf("Command %s cancelled: %s", a.Cmd, ctx.Err()))
+		}
 		exerr, exerr_ok := rerr.(*exec.ExitError)
 		if exerr_ok {
-			w.error("Command failed with status ", exerr)
-		} else {
-			w.error(rerr)
+			result := Failed(fmt.Errorf("Command failed with status %s", exerr))
+			if a.retryable(exerr.ExitCode()) {
+				result = Retryable(result.Err)
+			}
+			return result.Set("exit_code", exerr.ExitCode())
 		}
-		return false
+		/* Couldn't run the command at all */
+		return Failed(rerr)
 	}
 	w.report_action("Command successful")
-	return true
+	return Succeeded().Set("exit_code", 0)
+}
+
+func (a *RunAction) retryable(code int) bool {
+	for _, c := range a.RetryExitCodes {
+		if c == code {
+			return true
+		}
+	}
+	return false
 }
@@ -1,10 +1,12 @@
 package watch
 
 import (
+	"context"
 	"io/ioutil"
 	"log"
 	"os"
 	"testing"
+	"time"
 )
 
 // These tests assume a unix like system, but ATM that's all that's expected.
@@ -36,7 +38,7 @@ func Test_RunOK(t *testing.T) {
 				Cmd: "/bin/echo",
 			},
 		},
-		AfterFileAction: func(file string) {
+		AfterFileAction: func(file string, result *Result) {
 			wait <- true
 		},
 	}
@@ -74,7 +76,7 @@ func Test_RunFail(t *testing.T) {
 	}
 	defer func() { os.Remove(archDir) }()
 
-	wait := make(chan bool)
+	wait := make(chan *Result)
 	cfg := Config{
 		dontBlock: true,
 		Dir:        tempDir,
@@ -87,8 +89,8 @@ func Test_RunFail(t *testing.T) {
 				Cmd: "/bin/false",
 			},
 		},
-		AfterFileAction: func(file string) {
-			wait <- true
+		AfterFileAction: func(file string, result *Result) {
+			wait <- result
 		},
 	}
 
@@ -103,7 +105,10 @@ func Test_RunFail(t *testing.T) {
 	tempFile.Close()
 	os.Rename(tempFile.Name(), tempDir+string(os.PathSeparator)+"foo")
 
-	<-wait
+	result := <-wait
+	if result.Outcome != FailureOutcome || result.Meta["exit_code"] != "1" {
+		t.Error("Unexpected result ", result, result.Meta)
+	}
 
 	_, err = os.Open(tempDir + string(os.PathSeparator) + "foo")
 	if err != nil {
@@ -149,7 +154,7 @@ func Test_RunArgs(t *testing.T) {
 				
 			},
 		},
-		AfterFileAction: func(file string) {
+		AfterFileAction: func(file string, result *Result) {
 			wait <- true
 		},
 	}
@@ -211,7 +216,7 @@ func Test_RunPostArgs(t *testing.T) {
 				
 			},
 		},
-		AfterFileAction: func(file string) {
+		AfterFileAction: func(file string, result *Result) {
 			wait <- true
 		},
 	}
@@ -234,3 +239,57 @@ func Test_RunPostArgs(t *testing.T) {
 		t.Error("Not able to open the file which should now exist in " + otherDir)
 	}
 }
+
+func Test_RunTimeout(t *testing.T) {
+
+	tempDir, err := ioutil.TempDir("", "springboard")
+	if err != nil {
+		panic(err)
+	}
+	defer func() { os.RemoveAll(tempDir) }()
+
+	wait := make(chan bool)
+	cfg := Config{
+		dontBlock:     true,
+		Dir:           tempDir,
+		Debug:         true,
+		ActionTimeout: 100 * time.Millisecond,
+		Actions: []Action{
+			&RunAction{
+				Cmd:  "/bin/sleep",
+				Args: []string{"5"},
+			},
+		},
+		AfterFileAction: func(file string, result *Result) {
+			wait <- true
+		},
+	}
+
+	Watch(&cfg)
+	start := time.Now()
+	_, err = os.Create(tempDir + string(os.PathSeparator) + "foo")
+	if err != nil {
+		panic(err)
+	}
+
+	<-wait
+
+	if time.Since(start) > 2*time.Second {
+		t.Error("Command wasn't cancelled by the action timeout")
+	}
+	_, err = os.Open(tempDir + string(os.PathSeparator) + "foo")
+	if err != nil {
+		t.Error("Not able to open the file which should remain")
+	}
+}
+
+func Test_RunRetryExitCodes(t *testing.T) {
+	is := makeIs(t)
+	ctx := context.Background()
+	w := newWatcher(&Config{})
+
+	a := &RunAction{Cmd: "/bin/false"}
+	is(a.Process(ctx, w, "foo").Outcome, FailureOutcome, "non-zero exit is a failure")
+	a.RetryExitCodes = []int{75, 1}
+	is(a.Process(ctx, w, "foo").Outcome, RetryOutcome, "exit code we were told to retry")
+}
@@ -0,0 +1,81 @@
+package watch
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+/* A range of HTTP status codes, From and To included */
+type StatusRange struct {
+	From, To int
+}
+
+/*
+  A set of HTTP status codes, eg the ones PostAction counts as success.
+  Written as a comma separated list of codes and ranges, eg "200-299,409".
+*/
+type StatusCodes []StatusRange
+
+/* What PostAction counts as success unless PostAction.SuccessCodes says otherwise */
+var DefaultSuccessCodes = StatusCodes{{http.StatusOK, http.StatusOK}}
+
+func ParseStatusCodes(s string) (StatusCodes, error) {
+	var codes StatusCodes
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		from, to := part, part
+		if i := strings.Index(part, "-"); i >= 0 {
+			from, to = part[:i], part[i+1:]
+		}
+		r, err := statusRange(strings.TrimSpace(from), strings.TrimSpace(to))
+		if err != nil {
+			return nil, fmt.Errorf("bad status codes %q: %s", s, err)
+		}
+		codes = append(codes, r)
+	}
+	if len(codes) == 0 {
+		return nil, fmt.Errorf("no status codes in %q", s)
+	}
+	return codes, nil
+}
+
+func statusRange(from, to string) (StatusRange, error) {
+	var r StatusRange
+	var err error
+	if r.From, err = strconv.Atoi(from); err != nil {
+		return r, err
+	}
+	if r.To, err = strconv.Atoi(to); err != nil {
+		return r, err
+	}
+	if r.From < 100 || r.To > 599 || r.From > r.To {
+		return r, fmt.Errorf("%d-%d isn't a range of HTTP status codes", r.From, r.To)
+	}
+	return r, nil
+}
+
+func (c StatusCodes) Has(code int) bool {
+	for _, r := range c {
+		if code >= r.From && code <= r.To {
+			return true
+		}
+	}
+	return false
+}
+
+func (c StatusCodes) String() string {
+	parts := make([]string, len(c))
+	for i, r := range c {
+		if r.From == r.To {
+			parts[i] = strconv.Itoa(r.From)
+		} else {
+			parts[i] = fmt.Sprint(r.From, "-", r.To)
+		}
+	}
+	return strings.Join(parts, ",")
+}
@@ -0,0 +1,25 @@
+package watch
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestStatusCodes(t *testing.T) {
+	is := makeIs(t)
+
+	codes, err := ParseStatusCodes(" 200-299, 409 ")
+	is(err, nil, "parsed")
+	is(codes.String(), "200-299,409", "round trip")
+	for code, want := range map[int]bool{200: true, 201: true, 299: true, 409: true, 199: false, 300: false, 404: false} {
+		is(codes.Has(code), want, fmt.Sprint(codes, " has ", code))
+	}
+	is(DefaultSuccessCodes.Has(200), true, "200 succeeds by default")
+	is(DefaultSuccessCodes.Has(201), false, "only 200 succeeds by default")
+
+	for _, bad := range []string{"", ",", "ok", "200-", "299-200", "99", "200-600"} {
+		if _, err := ParseStatusCodes(bad); err == nil {
+			t.Fatal(bad, " accepted")
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package watch
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+/*
+  A parsed PostAction.To: the part before any ? (outside of {{ }}) and the
+  query after it.
+*/
+type urlTemplate struct {
+	path  *template.Template
+	query *template.Template /* nil without a query */
+}
+
+/*
+  Parse a URL template, nil for a plain URL with nothing to fill in. Like
+  parseTemplate it's tried on a sample file, to catch mistakes early.
+*/
+func parseURLTemplate(to string) (*urlTemplate, error) {
+	if !strings.Contains(to, "{{") {
+		return nil, nil
+	}
+
+	path, query, hasQuery := splitQuery(to)
+	t := &urlTemplate{}
+	var err error
+	if t.path, err = template.New("url").Option("missingkey=error").Parse(path); err != nil {
+		return nil, fmt.Errorf("bad URL template: %s", err)
+	}
+	if hasQuery {
+		if t.query, err = template.New("query").Option("missingkey=error").Parse(query); err != nil {
+			return nil, fmt.Errorf("bad URL template: %s", err)
+		}
+	}
+	if _, err := t.expand(sampleFileDetails()); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+/* Split at the first ? which isn't inside {{ }} */
+func splitQuery(to string) (path, query string, found bool) {
+	for i := 0; i < len(to); i++ {
+		if strings.HasPrefix(to[i:], "{{") {
+			end := strings.Index(to[i:], "}}")
+			if end < 0 {
+				break
+			}
+			i += end + 1
+			continue
+		}
+		if to[i] == '?' {
+			return to[:i], to[i+1:], true
+		}
+	}
+	return to, "", false
+}
+
+/* Fill in the template for file */
+func (t *urlTemplate) expand(file *fileDetails) (string, error) {
+	var to strings.Builder
+	if err := t.path.Execute(&to, &templateFile{file: file, escaping: pathEscaping}); err != nil {
+		return "", fmt.Errorf("URL template: %s", err)
+	}
+	if t.query != nil {
+		to.WriteString("?")
+		if err := t.query.Execute(&to, &templateFile{file: file, escaping: queryEscaping}); err != nil {
+			return "", fmt.Errorf("URL template: %s", err)
+		}
+	}
+	return to.String(), nil
+}
@@ -0,0 +1,61 @@
+package watch
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestURLTemplate(t *testing.T) {
+	is := makeIs(t)
+	tempDir, err := ioutil.TempDir("", "springboard")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	os.MkdirAll(filepath.Join(tempDir, "acme corp", "orders"), 0777)
+	file := filepath.Join(tempDir, "acme corp", "orders", "big & small#1.xml")
+	ioutil.WriteFile(file, []byte("kruncha"), 0666)
+	modified := time.Date(2020, 2, 3, 4, 5, 6, 0, time.UTC)
+	os.Chtimes(file, modified, modified)
+	rel, _ := filepath.Rel(tempDir, file)
+
+	expand := func(to, rel string) string {
+		tmpl, err := parseURLTemplate(to)
+		is(err, nil, "parsed "+to)
+		details, err := newFileDetails(file, rel)
+		is(err, nil, "stat")
+		url, err := tmpl.expand(details)
+		is(err, nil, "expanded "+to)
+		return url
+	}
+
+	is(expand("https://store/api/files/{{.Dir}}/{{.Name}}", rel),
+		"https://store/api/files/acme%20corp/orders/big%20&%20small%231.xml", "path escaped")
+	is(expand("https://store/api/{{.Stem}}.{{.Ext}}?name={{.Name}}&dir={{.Dir}}&size={{.Size}}", rel),
+		"https://store/api/big%20&%20small%231.xml?name=big+%26+small%231.xml&dir=acme+corp%2Forders&size=7", "query escaped")
+	is(expand("https://store/{{.Name}}?at={{.ModTime}}&sha256={{.SHA256}}&md5={{.MD5}}", "big & small#1.xml"),
+		"https://store/big%20&%20small%231.xml?at=2020-02-03T04%3A05%3A06Z"+
+			"&sha256=fc5a43f8b7e41995c723f950e285a44bd49355c32cd4d223827d6941cb49fcb7&md5=ieiACg01us2AezCA6idr7A%3D%3D",
+		"hashes and mtime, no dir at the top")
+	is(expand("https://store{{.Path}}?path={{.Path}}", rel),
+		"https://store"+filepath.ToSlash(tempDir)+"/acme%20corp/orders/big%20&%20small%231.xml?path="+url.QueryEscape(filepath.ToSlash(file)), "full path")
+	is(expand(`https://store/{{"a?b"}}?q={{.Ext}}`, rel), "https://store/a?b?q=xml", "? inside {{ }} doesn't start the query")
+
+	tmpl, err := parseURLTemplate("https://store/plain?x=1")
+	is(err, nil, "plain URL")
+	is(tmpl == nil, true, "nothing to fill in")
+	if (&PostAction{To: "https://store/{{.Name"}).Check() == nil {
+		t.Fatal("bad template accepted")
+	}
+	if (&PostAction{To: "https://store/{{.Filename}}"}).Check() == nil {
+		t.Fatal("unknown field accepted")
+	}
+	if (&PostAction{To: "https://store/files?name={{.Filename}}"}).Check() == nil {
+		t.Fatal("unknown field in the query accepted")
+	}
+}
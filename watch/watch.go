@@ -1,6 +1,8 @@
 package watch
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/draxil/gomv"
 	"github.com/theckman/go-flock"
@@ -8,20 +10,110 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 )
 
 /*
-   describes the interface required of a directory action, eg PostAction
+   An action to perform on new files, eg PostAction. An action must implement
+   one of ResultAction, ContextAction or BoolAction, we use the first of those
+   it implements. Anything else is rejected when the watcher starts.
 */
-type Action interface {
+type Action interface{}
+
+/*
+   The preferred kind of action. ctx is cancelled if the watcher gives up on
+   the file (shutdown, or the action taking longer than Config.ActionTimeout).
+   The Result decides what happens to the file next.
+*/
+type ResultAction interface {
+	Process(ctx context.Context, w *Watcher, file string) *Result
+}
+
+/*
+   An action which can be cancelled, as ResultAction, returning nil on
+   success. An error is a permanent failure, unless ctx was done.
+*/
+type ContextAction interface {
+	Process(ctx context.Context, w *Watcher, file string) error
+}
+
+/*
+   The original action interface, return true for success. These can't be
+   cancelled and their failures are permanent, prefer ResultAction.
+*/
+type BoolAction interface {
 	Process(*Watcher, string) bool
 }
 
+/* Adapts a ContextAction into a ResultAction */
+type contextAction struct {
+	action ContextAction
+}
+
+func (a contextAction) Process(ctx context.Context, w *Watcher, file string) *Result {
+	err := a.action.Process(ctx, w, file)
+	if err == nil {
+		return Succeeded()
+	}
+	if ctx.Err() != nil {
+		return Retryable(err)
+	}
+	return Failed(err)
+}
+
+/*
+  Adapts a BoolAction into a ResultAction. The action can't be cancelled, so
+  if ctx is done first we stop waiting for it and leave it to finish in the
+  background. We can't tell whether a failure is worth retrying, so failures
+  are permanent.
+*/
+type boolAction struct {
+	action BoolAction
+}
+
+func (a boolAction) Process(ctx context.Context, w *Watcher, file string) *Result {
+	done := make(chan bool, 1)
+	go func() {
+		done <- a.action.Process(w, file)
+	}()
+
+	select {
+	case <-ctx.Done():
+		return Retryable(ctx.Err())
+	case ok := <-done:
+		if !ok {
+			return Failed(fmt.Errorf("%T failed", a.action))
+		}
+	}
+	return Succeeded()
+}
+
+/* The ResultAction to run for a, adapting older kinds of action */
+func resultActionFor(a Action) (ResultAction, error) {
+	switch action := a.(type) {
+	case ResultAction:
+		return action, nil
+	case ContextAction:
+		return contextAction{action}, nil
+	case BoolAction:
+		return boolAction{action}, nil
+	}
+	return nil, fmt.Errorf("%T is not an action, it implements none of ResultAction, ContextAction or BoolAction", a)
+}
+
+/* How many files we process at once unless Config.Workers says otherwise */
+const DefaultWorkers = 4
+
 const (
 	NoParanoia = 0 + iota
 	BasicParanoia
 	ExtraParanoia
+	MarkerParanoia /* Wait for a marker file, see Config.MarkerSuffixes */
+	EventParanoia  /* Wait until there have been no write events for Config.QuietPeriod */
+	StableParanoia /* Wait until the file's size stays the same, see Config.ParanoiaWindow */
 )
 
 type ParanoiaLevel int
@@ -30,17 +122,41 @@ type ParanoiaLevel int
   A watcher config: a directory to watch,  it's associated actions and any global options
 */
 type Config struct {
-	Actions              []Action              /* List of actions to perform when new files arrive */
-	AfterFileAction      func(filename string) /* Callback to call after a file action */
-	ArchiveDir           string                /* If set, place to store files after they have been successfully processed */
-	ErrorDir             string                /* If set, place to store files if an action fails */
-	Dir                  string                /* Directory to watch */
-	ProcessExistingFiles bool                  /* Process pre-existing files on startup */
-	Paranoia             ParanoiaLevel         /* Wait and see if file is finished writing */
-	Debug                bool                  /* Verbose output */
-	ReportActions        bool                  /* Log actions */
-	ReportErrors         bool                  /* Error output */
-	TestingOptions       []string              /* Misc behaviour flags largely for testing */
+	Actions              []Action                              /* List of actions to perform when new files arrive */
+	Rules                []Rule                                /* If set, the first matching rule decides what happens to a file, Actions are for files no rule matches */
+	AfterFileAction      func(filename string, result *Result) /* Callback to call after a file action */
+	ArchiveDir           string                                /* If set, place to store files after they have been successfully processed */
+	ErrorDir             string                                /* If set, place to store files if an action fails */
+	Dir                  string                                /* Directory to watch */
+	ProcessExistingFiles bool                                  /* Process pre-existing files on startup */
+	Recursive            bool                                  /* Also watch all subdirectories of Dir, including ones created later */
+	Include              []string                              /* If set, only process files matching one of these globs (or re:REGEX) */
+	Exclude              []string                              /* Never process files matching one of these globs (or re:REGEX) */
+	Workers              int                                   /* How many files to process at once, DefaultWorkers if not set */
+	ActionTimeout        time.Duration                         /* If set, cancel actions which run longer than this */
+	Retry                RetryPolicy                           /* How to retry files which fail in a way worth retrying */
+	StateDir             string                                /* If set, keep track of pending & failed files here so we can carry on after a restart */
+	ShutdownTimeout      time.Duration                         /* How long a shutdown (see Watcher.Shutdown) triggered by a signal waits for files in progress */
+	Backend              string                                /* How we find out about new files, FsnotifyBackend (the default) or PollBackend */
+	PollInterval         time.Duration                         /* With PollBackend, how often to look. DefaultPollInterval if not set */
+	RescanInterval       time.Duration                         /* If set, look through Dir this often for files we've missed (eg because events were dropped) */
+	RescanAge            time.Duration                         /* Rescans only pick up files which haven't been modified for this long, DefaultRescanAge if not set */
+	Paranoia             ParanoiaLevel                         /* Wait and see if file is finished writing */
+	MarkerSuffixes       []string                              /* With MarkerParanoia, foo.xml is ready once foo.xml plus one of these exists. DefaultMarkerSuffixes if not set */
+	ArchiveMarkers       bool                                  /* Move markers to the archive / error directory with their files, rather than deleting them */
+	QuietPeriod          time.Duration                         /* With EventParanoia, how long a file has to go without being written to. DefaultQuietPeriod if not set */
+	ParanoiaWindow       time.Duration                         /* With StableParanoia, how often to look at the file. DefaultParanoiaWindow if not set */
+	ParanoiaSamples      int                                   /* With StableParanoia, how many looks in a row have to find the same size and modification time. DefaultParanoiaSamples if not set */
+	ParanoiaMaxWait      time.Duration                         /* If set, a file which isn't ready after this long is treated as failed */
+	Dedup                bool                                  /* Don't process a file with the same content as one we've already processed successfully */
+	DedupRetention       time.Duration                         /* How long Dedup remembers a file for, DefaultDedupRetention if not set. Remembered across restarts with a StateDir */
+	DuplicateDir         string                                /* Where Dedup puts duplicates, if not set they're deleted */
+	Name                 string                                /* Optional name, used to tell watchers apart in the logs (see Manager) */
+	Logger               *log.Logger                           /* Where to log, the standard logger if not set */
+	Debug                bool                                  /* Verbose output */
+	ReportActions        bool                                  /* Log actions */
+	ReportErrors         bool                                  /* Error output */
+	TestingOptions       []string                              /* Misc behaviour flags largely for testing */
 	dontBlock            bool
 }
 
@@ -48,36 +164,165 @@ type Config struct {
    An active watcher.
 */
 type Watcher struct {
-	Config    *Config
-	fswatch   *fsnotify.Watcher
-	test_opts map[string]bool
+	Config       *Config
+	backend      Backend
+	shared       bool /* backend belongs to a Manager, which passes our events on */
+	test_opts    map[string]bool
+	dirs         map[string]bool /* Directories currently being watched */
+	skipDirs     []string        /* Absolute paths of directories we never watch (archive etc) */
+	dirLock      sync.Mutex
+	filter       *filter
+	routes       []*route /* One per Config.Rules */
+	defaultRoute *route
+	journal      *journal
+	hashes       *hashStore  /* What we've processed, with Config.Dedup */
+	queue        chan string /* Files waiting for a worker, in the order they arrived */
+	workers      sync.WaitGroup
+
+	/* Shutdown state */
+	ctx        context.Context /* Cancelled when in-flight files should be abandoned */
+	cancel     context.CancelFunc
+	stopping   chan struct{} /* Closed once we stop accepting files */
+	finished   chan struct{} /* Closed once we're completely done */
+	stopOnce   sync.Once
+	finishOnce sync.Once
+	lock       sync.Mutex
+	claimed    map[string]bool          /* Files queued or being processed, so we never have the same one twice */
+	seen       map[string]bool          /* Files we've picked up which are still there, so writing to them doesn't make them new */
+	ignored    map[string]bool          /* Files which were there before we started, which rescans leave alone */
+	dropped    []string                 /* Files we couldn't queue because we were stopping */
+	retries    map[string]*pendingRetry /* Files waiting for their next attempt */
+	lastWrite  map[string]time.Time     /* When we last saw each file written to, for EventParanoia */
 }
 
 /*
   Start watching the directory in this config. This is a blocking activity so can be wrapped in a goroutine if you want to do other things!
 */
 func Watch(c *Config) error {
-	watcher, err := fsnotify.NewWatcher()
+	w, err := NewWatcher(c)
 	if err != nil {
 		return err
 	}
 
-	var w Watcher
-	w.fswatch = watcher
-	w.Config = c
+	return w.Run()
+}
+
+/*
+  Create a watcher for this config without starting it, so you can keep hold of
+  it to Shutdown or Close later. Call Run to start watching.
+*/
+func NewWatcher(c *Config) (*Watcher, error) {
+	w := newWatcher(c)
+	backend, err := newBackend(c, w.error)
+	if err != nil {
+		return nil, err
+	}
+	w.backend = backend
+	return w, nil
+}
 
-	return w.run()
+/* A watcher which isn't watching anything (yet) */
+func newWatcher(c *Config) *Watcher {
+	w := &Watcher{
+		Config:   c,
+		claimed:  make(map[string]bool),
+		seen:     make(map[string]bool),
+		ignored:  make(map[string]bool),
+		retries:  make(map[string]*pendingRetry),
+		stopping: make(chan struct{}),
+		finished: make(chan struct{}),
+	}
+	w.ctx, w.cancel = context.WithCancel(context.Background())
+	return w
 }
 
 /*
-   Close the watcher, stop watching!
+   Close the watcher, stop watching! Files already being processed are left to
+   get on with it, though the state directory is let go of straight away, see
+   Shutdown if you want to wait for them.
 */
 func (w *Watcher) Close() {
-	w.fswatch.Close()
+	w.stop()
+	w.finish()
+}
+
+/*
+  Stop the watcher gracefully: stop accepting new files, then wait for the files
+  currently being processed to finish. Files still waiting in the queue aren't
+  started. If ctx is done before the files in progress have finished they're
+  cancelled, we wait for the workers to give up on them and return ctx's
+  error. Either way you get back the list of files which were seen but not
+  processed, these are left where they are.
+*/
+func (w *Watcher) Shutdown(ctx context.Context) (unprocessed []string, err error) {
+	w.stop()
+	defer w.finish()
+
+	idle := make(chan struct{})
+	go func() {
+		w.workers.Wait()
+		close(idle)
+	}()
+
+	select {
+	case <-idle:
+	case <-ctx.Done():
+		err = ctx.Err()
+		/* Files we interrupt end up in w.dropped */
+		w.cancel()
+		<-idle
+	}
+
+	/* Files waiting to be retried are picked up from the journal next time */
+	unprocessed = append(unprocessed, w.cancelRetries()...)
+
+	/* Anything still queued never got started */
+	for {
+		select {
+		case path := <-w.queue:
+			unprocessed = append(unprocessed, path)
+		default:
+			w.lock.Lock()
+			unprocessed = append(unprocessed, w.dropped...)
+			w.lock.Unlock()
+			return
+		}
+	}
 }
 
-func (w *Watcher) run() error {
+/*
+  Stop accepting files: stop watching and tell the workers to stop once
+  they've finished what they're doing.
+*/
+func (w *Watcher) stop() {
+	w.stopOnce.Do(func() {
+		close(w.stopping)
+		if w.shared {
+			/* Other watchers are still using it, just drop our watches */
+			w.removeDir(w.Config.Dir)
+		} else if w.backend != nil {
+			w.backend.Close()
+		}
+	})
+}
 
+/*
+  We're done: let go of the state directory, so another watcher can have it,
+  and tell anyone waiting for us. However we stop we end up here.
+*/
+func (w *Watcher) finish() {
+	w.finishOnce.Do(func() {
+		w.hashes.close()
+		w.journal.close()
+		close(w.finished)
+	})
+}
+
+/*
+  Check the config & set up everything a watcher needs before it can process
+  files.
+*/
+func (w *Watcher) prepare() error {
 	/* Populate testing flags
 	 */
 	w.test_opts = make(map[string]bool)
@@ -91,128 +336,706 @@ func (w *Watcher) run() error {
 		w.Config.dontBlock = true
 	}
 
-	done := make(chan bool)
+	filter, err := newFilter(w.Config.Include, w.Config.Exclude)
+	if err != nil {
+		return err
+	}
+	w.filter = filter
 
-	/* before we start watching dispatch goroutines to process any pre-existing files:
-	 */
-	if w.Config.ProcessExistingFiles {
-		w.process_existing()
+	if err := w.prepareRoutes(); err != nil {
+		return err
 	}
 
-	/* Setup goroutine which just waits for events and errors from the filesystem watcher:
-	 */
-	var werr error
-	go func() {
-		for {
-			select {
-			case event := <-w.fswatch.Events:
-				go w.handle_event(&event)
-			case err := <-w.fswatch.Errors:
-				werr = err
-				done <- true
-			}
+	if w.Config.StateDir != "" {
+		w.journal, err = openJournal(w.Config.StateDir)
+		if err != nil {
+			return err
 		}
+	}
 
-	}()
+	w.dirs = make(map[string]bool)
+	w.skipDirs = nil
+	dirs := []string{w.Config.ArchiveDir, w.Config.ErrorDir, w.Config.StateDir, w.Config.DuplicateDir}
+	for _, r := range w.Config.Rules {
+		dirs = append(dirs, r.ArchiveDir, r.ErrorDir)
+	}
+	for _, d := range dirs {
+		if d == "" {
+			continue
+		}
+		if abs, err := filepath.Abs(d); err == nil {
+			w.skipDirs = append(w.skipDirs, abs)
+		}
+	}
+	return nil
+}
+
+/*
+  Run the watcher. Unless the config says not to block this doesn't return
+  until the watcher fails, or is closed or shutdown.
+*/
+func (w *Watcher) Run() error {
+	if err := w.start(); err != nil {
+		return err
+	}
 
-	/* Add the actual directory we're watching to the fswatcher
+	/* Setup goroutine which just waits for events and errors from the filesystem watcher:
 	 */
-	werr = w.fswatch.Add(w.Config.Dir)
+	done := make(chan error, 1)
+	go w.loop(w.backend.Events(), w.backend.Errors(), done)
 
 	/* Assuming all has gone well (and config isn't telling us not to block)
-	   then just wait for a signal down our "done" channel
+	   then just wait until something goes wrong or we're stopped
 	*/
-	if werr == nil && !w.Config.dontBlock {
-		<-done
-		defer w.Close()
+	var werr error
+	if !w.Config.dontBlock {
+		select {
+		case werr = <-done:
+			w.Close()
+		case <-w.finished:
+		}
 	}
 
 	return werr
 }
 
-func (w *Watcher) process_existing() {
+/*
+  Get everything going apart from reading events: workers, anything left over
+  from last time or already in the directory, and the watches themselves.
+*/
+func (w *Watcher) start() error {
+	if err := w.prepare(); err != nil {
+		return err
+	}
+
+	if w.Config.Dedup {
+		hashes, err := openHashStore(w.Config.StateDir, w.Config.DedupRetention)
+		if err != nil {
+			w.journal.close()
+			return err
+		}
+		w.hashes = hashes
+	}
+
+	w.startWorkers()
+
+	/* before we start watching queue up anything we were in the middle of
+	   last time, and any pre-existing files:
+	*/
+	w.resume_pending()
+	if w.Config.ProcessExistingFiles {
+		if err := w.process_existing(); err != nil {
+			w.Close()
+			return err
+		}
+	} else if w.Config.RescanInterval > 0 {
+		w.ignoreExisting()
+	}
+
+	/* Add the actual directory we're watching to the backend (and in
+	   recursive mode everything below it)
+	*/
+	if err := w.addDir(w.Config.Dir); err != nil {
+		w.Close()
+		return err
+	}
+
+	if w.Config.RescanInterval > 0 {
+		go w.rescanLoop()
+	}
+	return nil
+}
+
+/*
+  Handle events until events is closed or we're stopping. A watch error is
+  sent to done and stops the loop.
+*/
+func (w *Watcher) loop(events <-chan fsnotify.Event, errors <-chan error, done chan<- error) {
+	for {
+		select {
+		case <-w.stopping:
+			return
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			w.handle_event(&event)
+		case err, ok := <-errors:
+			if !ok {
+				return
+			}
+			if err == fsnotify.ErrEventOverflow && w.Config.RescanInterval > 0 {
+				w.error("Missed some events, the next rescan will pick up any files we missed: ", err)
+				continue
+			}
+			done <- err
+			return
+		}
+	}
+}
+
+/*
+  Start the pool of goroutines which take files off the queue and process them.
+  Once we're stopping workers finish the file they're on and return, anything
+  left in the queue is for Shutdown to report.
+*/
+func (w *Watcher) startWorkers() {
+	workers := w.Config.Workers
+	if workers <= 0 {
+		workers = DefaultWorkers
+	}
+
+	w.queue = make(chan string, workers)
+	w.workers.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer w.workers.Done()
+			for {
+				/* Check for stopping first, otherwise select could pick more work */
+				select {
+				case <-w.stopping:
+					return
+				default:
+				}
+
+				select {
+				case <-w.stopping:
+					return
+				case path := <-w.queue:
+					w.handleFile(path)
+					w.release(path)
+				}
+			}
+		}()
+	}
+}
+
+/*
+  Hand a file to the workers. Blocks while the queue is full, so a big drop of
+  files slows down how fast we read events rather than piling up work. A file
+  which is already queued or being processed isn't queued again. Returns
+  false if the watcher is stopping, in which case the file is left alone.
+*/
+func (w *Watcher) enqueue(path string) bool {
+	path = w.markedFile(path)
+	if !w.claim(path) {
+		w.debug("Already dealing with ", path)
+		return true
+	}
+
+	/* Check for stopping first, otherwise select could queue a file Shutdown has already reported on */
+	select {
+	case <-w.stopping:
+	default:
+		select {
+		case <-w.stopping:
+		case w.queue <- path:
+			return true
+		}
+	}
+
+	w.release(path)
+	w.addDropped(path)
+	return false
+}
+
+/*
+  Take ownership of path until release, false if something else already has
+  it.
+*/
+func (w *Watcher) claim(path string) bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.claimed[path] {
+		return false
+	}
+	w.claimed[path] = true
+	w.seen[path] = true
+	return true
+}
+
+func (w *Watcher) release(path string) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	delete(w.claimed, path)
+}
+
+/* Have we picked up path before (and it hasn't gone away since)? */
+func (w *Watcher) wasSeen(path string) bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.seen[path]
+}
+
+func (w *Watcher) forgetSeen(path string) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	delete(w.seen, path)
+	delete(w.ignored, path)
+}
+
+/* Remember a file we gave up on because we're stopping */
+func (w *Watcher) addDropped(path string) {
+	w.lock.Lock()
+	w.dropped = append(w.dropped, path)
+	w.lock.Unlock()
+}
+
+func (w *Watcher) process_existing() error {
 	w.debug("Processing existing files")
-	f, err := os.Open(w.Config.Dir)
+
+	paths, err := w.existingFiles()
 	if err != nil {
-		panic(fmt.Sprintf("Error opening directory: %s", err))
+		return fmt.Errorf("Error opening directory: %s", err)
 	}
+	w.feed(paths)
+	return nil
+}
 
-	fi, err := f.Readdirnames(0)
-	if err != nil {
-		panic(err)
+/*
+  The files in the directory (or below it in recursive mode), apart from
+  any the journal says we're part way through, which are resume_pending's
+  job.
+*/
+func (w *Watcher) existingFiles() ([]string, error) {
+	var paths []string
+	if w.Config.Recursive {
+		paths = w.filesBelow(w.Config.Dir)
+	} else {
+		f, err := os.Open(w.Config.Dir)
+		if err != nil {
+			return nil, err
+		}
+
+		fi, err := f.Readdirnames(0)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, v := range fi {
+			/* Unlike the usual entrypoint these are "just filenames" so glue on the path first */
+			path := w.Config.Dir + string(os.PathSeparator) + v
+			paths = append(paths, filepath.Clean(path))
+		}
 	}
 
-	for _, v := range fi {
-		w.report_action("Processing existing file: " + v)
+	var fresh []string
+	for _, path := range w.markedFiles(paths) {
+		if e, ok := w.journal.get(path); !ok || e.State != PendingState {
+			fresh = append(fresh, path)
+		}
+	}
+	return fresh, nil
+}
 
-		/* Unlike the usual entrypoint these are "just filenames" so glue on the path first */
-		path := w.Config.Dir + string(os.PathSeparator) + v
-		path = filepath.Clean(path)
-		go w.handleFile(path)
+/*
+  Queue up a list of existing files. The listing is taken now, before we're
+  watching, but feeding the queue may take a while so let it happen in the
+  background.
+*/
+func (w *Watcher) feed(paths []string) {
+	go func() {
+		for _, path := range paths {
+			w.report_action("Processing existing file: " + path)
+			w.enqueue(path)
+		}
+	}()
+}
+
+/*
+  Queue up the files the journal says we hadn't finished with, each when it's
+  due to be retried.
+*/
+func (w *Watcher) resume_pending() {
+	dir := journalKey(w.Config.Dir)
+
+	var pending []JournalEntry
+	for _, e := range w.journal.list(PendingState) {
+		if rel, err := filepath.Rel(dir, e.Path); err != nil || strings.HasPrefix(rel, "..") {
+			/* Not ours */
+			continue
+		}
+		if _, err := os.Stat(e.Path); err != nil {
+			w.debug("Forgetting about ", e.Path, ": ", err)
+			w.logJournal(w.journal.remove(e.Path))
+			continue
+		}
+		pending = append(pending, e)
+	}
+
+	if len(pending) == 0 {
+		return
+	}
+	w.report_action("Resuming ", len(pending), " unfinished file(s)")
+	sort.SliceStable(pending, func(a, b int) bool { return pending[a].NextAttempt.Before(pending[b].NextAttempt) })
+
+	go func() {
+		for _, e := range pending {
+			if wait := time.Until(e.NextAttempt); wait > 0 {
+				select {
+				case <-w.stopping:
+					return
+				case <-time.After(wait):
+				}
+			}
+			w.report_action("Resuming ", e.Path, " after ", e.Attempts, " attempt(s)")
+			w.enqueue(e.Path)
+		}
+	}()
+}
+
+func (w *Watcher) logJournal(err error) {
+	if err != nil {
+		w.error("Could not update journal: ", err)
 	}
 }
 
 func (w *Watcher) handle_event(e *fsnotify.Event) {
-	/* We have had a signal from the fswatcher. Most things we don't care about, but Create events we are excited by: */
-	if e.Op == fsnotify.Create {
+	if w.Config.Paranoia == EventParanoia {
+		switch {
+		case e.Op&(fsnotify.Create|fsnotify.Write) != 0:
+			w.noteWrite(e.Name)
+		case e.Op&(fsnotify.Remove|fsnotify.Rename) != 0:
+			w.forgetWrites(e.Name)
+		}
+	}
+
+	/* We have had a signal from the backend. Create events are new files,
+	   including ones renamed, moved or linked into the directory.
+	*/
+	switch {
+	case e.Op&fsnotify.Create != 0:
 		w.debug("Create event for ", e.Name)
-		w.handleFile(e.Name)
+		if w.Config.Recursive && w.isNewDir(e.Name) {
+			w.handleNewDir(e.Name)
+			return
+		}
+		w.enqueue(e.Name)
+
+	case e.Op&fsnotify.Write != 0:
+		/* Some platforms only tell us about a new file when it's written
+		   to, so a write to a file we haven't seen means it's new.
+		*/
+		if !w.wasSeen(w.markedFile(e.Name)) {
+			w.debug("Write event for new file ", e.Name)
+			w.enqueue(e.Name)
+		}
+
+	case e.Op&(fsnotify.Remove|fsnotify.Rename) != 0:
+		/* Renames are the old name going away, the new name gets a Create */
+		w.forgetSeen(e.Name)
+
+		/* In recursive mode a directory going away needs its watches dropping */
+		if w.Config.Recursive {
+			w.removeDir(e.Name)
+		}
 	}
 }
 
+/*
+  Start watching dir, and in recursive mode every directory below it. Archive
+  and error directories are never watched.
+*/
+func (w *Watcher) addDir(dir string) error {
+	if !w.Config.Recursive {
+		return w.watchDir(dir)
+	}
+
+	return filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			/* Something vanished underneath us, only the top level is fatal */
+			if path == dir {
+				return err
+			}
+			w.debug("Skipping ", path, ": ", err)
+			return nil
+		}
+		if !fi.IsDir() {
+			return nil
+		}
+		if w.skipDir(path) {
+			w.debug("Not watching ", path)
+			return filepath.SkipDir
+		}
+		return w.watchDir(path)
+	})
+}
+
+func (w *Watcher) watchDir(dir string) error {
+	dir = filepath.Clean(dir)
+	w.dirLock.Lock()
+	defer w.dirLock.Unlock()
+
+	if w.dirs[dir] {
+		return nil
+	}
+
+	if err := w.backend.Add(dir); err != nil {
+		return err
+	}
+	w.debug("Watching ", dir)
+	w.dirs[dir] = true
+	return nil
+}
+
+/*
+  Stop watching dir and anything we were watching below it.
+*/
+func (w *Watcher) removeDir(dir string) {
+	dir = filepath.Clean(dir)
+	prefix := dir + string(os.PathSeparator)
+
+	w.dirLock.Lock()
+	defer w.dirLock.Unlock()
+
+	for d := range w.dirs {
+		if d != dir && !strings.HasPrefix(d, prefix) {
+			continue
+		}
+		/* The kernel has usually dropped the watch already, so errors are expected */
+		if err := w.backend.Remove(d); err != nil {
+			w.debug("Removing watch on ", d, ": ", err)
+		}
+		w.debug("No longer watching ", d)
+		delete(w.dirs, d)
+	}
+}
+
+/* Is dir one of the directories we're watching? */
+func (w *Watcher) watching(dir string) bool {
+	w.dirLock.Lock()
+	defer w.dirLock.Unlock()
+	return w.dirs[filepath.Clean(dir)]
+}
+
+func (w *Watcher) isNewDir(path string) bool {
+	fi, err := os.Stat(path)
+	return err == nil && fi.IsDir()
+}
+
+/*
+  A directory has appeared inside a recursive watch. Watch it, then pick up
+  anything which landed in it before the watch was in place.
+*/
+func (w *Watcher) handleNewDir(dir string) {
+	if w.skipDir(dir) {
+		w.debug("Ignoring new directory ", dir)
+		return
+	}
+
+	if err := w.addDir(dir); err != nil {
+		w.error("Could not watch new directory ", dir, ": ", err)
+		return
+	}
+
+	for _, path := range w.markedFiles(w.filesBelow(dir)) {
+		w.enqueue(path)
+	}
+}
+
+/*
+  Is this one of the directories a recursive watch should stay out of?
+*/
+func (w *Watcher) skipDir(dir string) bool {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return false
+	}
+	for _, d := range w.skipDirs {
+		if abs == d {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+  All the files below dir, not descending into directories we don't watch.
+*/
+func (w *Watcher) filesBelow(dir string) (files []string) {
+	filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			w.debug("Skipping ", path, ": ", err)
+			return nil
+		}
+		if fi.IsDir() {
+			if path != dir && w.skipDir(path) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		files = append(files, filepath.Clean(path))
+		return nil
+	})
+	return
+}
+
+/*
+  Where a file lives relative to the watched directory, so in recursive mode
+  archived files keep their subdirectory.
+*/
+func (w *Watcher) relPath(path string) string {
+	rel, err := filepath.Rel(w.Config.Dir, path)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		_, filename := filepath.Split(path)
+		return filename
+	}
+	return rel
+}
+
+/* Result.Err for a file another process has locked */
+var errLocked = errors.New("locked by another process")
+
 func (w *Watcher) handleFile(path string) {
 
 	if !w.wantFile(path) {
+		w.forgetRetry(path)
 		return
 	}
 
+	if w.Config.Paranoia == MarkerParanoia && w.markerFor(path) == "" {
+		/* We'll be back when the marker turns up */
+		w.debug("No marker for ", path, " yet")
+		w.forgetSeen(path)
+		return
+	}
+
+	/* We never have the same file twice, but another process might be using it */
 	file_lock := flock.NewFlock(path)
 	locked, err := file_lock.TryLock()
 
-	if err != nil || !locked {
-		w.error("Lock failed")
-	} else {
+	switch {
+	case err != nil:
+		w.error("Could not lock ", path, ", carrying on anyway: ", err)
+	case !locked:
+		w.report_action("Leaving ", path, " alone: ", errLocked)
+		/* Let the next write to it have another go */
+		w.forgetSeen(path)
+		if w.Config.AfterFileAction != nil {
+			w.Config.AfterFileAction(path, Skipped(errLocked))
+		}
+		return
+	default:
 		defer file_lock.Unlock()
 	}
 
-	if w.Config.Paranoia > NoParanoia {
-		for w.paranoiaWait(path) {
-			time.Sleep(250 * time.Millisecond)
-		}
+	/* Note we're working on it, so if we're stopped part way through we can carry on next time */
+	if e, ok := w.journal.get(path); !ok || e.State != PendingState {
+		w.logJournal(w.journal.put(JournalEntry{Path: path, State: PendingState, Attempts: e.Attempts}))
 	}
 
-	actions_ok := w.actions_for_file(path)
+	if w.Config.Paranoia == EventParanoia {
+		defer w.forgetWrites(path)
+	}
+	notReady := w.waitReady(path)
+	if notReady == errInterrupted {
+		w.error("Gave up waiting for ", path, " to be ready")
+		w.addDropped(path)
+		return
+	}
 
-	_, filename := filepath.Split(path)
+	filename := w.relPath(path)
+	rt := w.routeFor(path, filename)
+	var result *Result
+	if notReady != nil {
+		result = Failed(notReady)
+	} else {
+		hash, dup := w.checkDuplicate(path)
+		if hash != "" {
+			defer w.hashes.end(hash)
+		}
+		if dup != nil {
+			result = dup
+		} else if result = w.actions_with_retries(path, rt); result == nil {
+			/* We'll be back when its retry is due */
+			return
+		}
+		if hash != "" && result.Ok() {
+			result.Set("sha256", hash)
+			if err := w.hashes.add(hash, path); err != nil {
+				w.error("Could not record ", path, " as processed: ", err)
+			}
+		}
+	}
 
+	/* Move the file to dir, returning where the file ends up */
 	already_archived := false
-	archive := func(dir string) {
+	archive := func(dir string) string {
 		if !already_archived {
 			w.report_action("Archiving ", path, " to ", dir)
-			e := gomv.MoveFile(path, dir+string(os.PathSeparator)+filename)
+			dest, e := moveFile(path, dir, filename)
 			if e != nil {
 				w.error(e)
 			} else {
 				already_archived = true
+				/* Whatever turns up with its name next is a new file */
+				w.forgetSeen(path)
 			}
+			return dest
 		}
+		return path
 	}
 
-	if !actions_ok && w.Config.ErrorDir != "" {
-		archive(w.Config.ErrorDir)
-	}
-	if actions_ok && w.Config.ArchiveDir != "" {
-		archive(w.Config.ArchiveDir)
+	switch result.Outcome {
+	case SuccessOutcome:
+		if rt.archiveDir != "" {
+			archive(rt.archiveDir)
+		}
+		w.finishMarker(path, filename, rt.archiveDir)
+		w.logJournal(w.journal.remove(path))
+	case FailureOutcome, RetryOutcome:
+		w.error("Processing ", path, " failed after ", result.Attempts, " attempt(s): ", result)
+		dest := path
+		if rt.errorDir != "" {
+			dest = archive(rt.errorDir)
+		}
+		w.finishMarker(path, filename, rt.errorDir)
+		w.logJournal(w.journal.remove(path))
+		w.logJournal(w.journal.put(JournalEntry{
+			Path:      dest,
+			State:     FailedState,
+			Attempts:  result.Attempts,
+			LastError: errString(result.Err),
+		}))
+	case SkipOutcome:
+		switch result.Err {
+		case errInterrupted:
+			w.report_action("Leaving ", path, " alone: ", result)
+			w.addDropped(path)
+		case errDuplicate:
+			w.discardDuplicate(path, filename)
+			w.forgetSeen(path)
+			w.logJournal(w.journal.remove(path))
+		default:
+			w.report_action("Leaving ", path, " alone: ", result)
+			w.logJournal(w.journal.remove(path))
+		}
 	}
 
 	if w.Config.AfterFileAction != nil {
-		w.Config.AfterFileAction(path)
+		w.Config.AfterFileAction(path, result)
 	}
 	if v := w.test_opts["exit_after_one"]; v {
 		w.Close()
 	}
 }
 
+/*
+  Move the file at path to rel inside dir, creating any directories needed.
+  Returns where the file ends up.
+*/
+func moveFile(path, dir, rel string) (string, error) {
+	dest := dir + string(os.PathSeparator) + rel
+	if err := os.MkdirAll(filepath.Dir(dest), 0777); err != nil {
+		return path, err
+	}
+	if err := gomv.MoveFile(path, dest); err != nil {
+		return path, err
+	}
+	return dest, nil
+}
+
 func (w *Watcher) wantFile(filepath string) bool {
 	fi, err := os.Stat(filepath)
 	if err != nil {
@@ -225,6 +1048,11 @@ func (w *Watcher) wantFile(filepath string) bool {
 		return false
 	}
 
+	if !w.filter.wanted(w.relPath(filepath)) {
+		w.debug("Rejecting filtered file ", filepath)
+		return false
+	}
+
 	// TODO: put this in as well when we have time to write a test
 	/*if ! fi.Mode().IsRegular() {
 		w.debug("Rejecting irregular file")
@@ -273,14 +1101,44 @@ func (w *Watcher) paranoiaWait(filepath string) bool {
 
 }
 
-func (w *Watcher) actions_for_file(file_path string) bool {
-	for _, v := range w.Config.Actions {
-		ok := v.Process(w, file_path)
-		if !ok {
-			return false
+/*
+  Run the route's actions in order, stopping at the first one which doesn't
+  succeed. The result is that of the last action run, with the details
+  reported by all of them.
+*/
+func (w *Watcher) actions_for_file(file_path string, rt *route) *Result {
+	result := Succeeded()
+	if rt.name != "" {
+		result.Set("rule", rt.name)
+	}
+	if rt.reject != nil {
+		result.Outcome, result.Err = FailureOutcome, rt.reject
+		return result
+	}
+	for _, v := range rt.actions {
+		r := w.runAction(v, file_path)
+		if r == nil {
+			r = Failed(fmt.Errorf("%T returned no result", v))
+		}
+		for k, val := range r.Meta {
+			result.Set(k, val)
+		}
+		result.Outcome, result.Err = r.Outcome, r.Err
+		if !r.Ok() {
+			break
 		}
 	}
-	return true
+	return result
+}
+
+func (w *Watcher) runAction(a ResultAction, file_path string) *Result {
+	ctx := w.ctx
+	if w.Config.ActionTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, w.Config.ActionTimeout)
+		defer cancel()
+	}
+	return a.Process(ctx, w, file_path)
 }
 
 func (w *Watcher) report_action(things ...interface{}) {
@@ -302,6 +1160,13 @@ func (w *Watcher) error(things ...interface{}) {
 
 func (w *Watcher) report(things ...interface{}) {
 	if w.Config.ReportErrors || w.Config.Debug {
-		log.Println(things...)
+		if w.Config.Name != "" {
+			things = append([]interface{}{"[" + w.Config.Name + "]"}, things...)
+		}
+		if w.Config.Logger != nil {
+			w.Config.Logger.Println(things...)
+		} else {
+			log.Println(things...)
+		}
 	}
 }
@@ -1,9 +1,15 @@
 package watch
 
 import (
+	"context"
+	"fmt"
+	"github.com/theckman/go-flock"
+	"gopkg.in/fsnotify.v1"
 	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
+	"sync"
 	"testing"
 	"time"
 )
@@ -21,7 +27,7 @@ func Test_NoAction(t *testing.T) {
 		dontBlock: true,
 		Dir:        tempDir,
 		Debug:      true,
-		AfterFileAction: func(file string) {
+		AfterFileAction: func(file string, result *Result) {
 			wait <- true
 			filename = file
 		},
@@ -62,7 +68,7 @@ func TestArchive(t *testing.T) {
 		dontBlock: true,
 		Dir:        tempDir,
 		Debug:      true,
-		AfterFileAction: func(file string) {
+		AfterFileAction: func(file string, result *Result) {
 			wait <- true
 			//filename = file
 		},
@@ -109,7 +115,7 @@ func TestErrorDir(t *testing.T){
 		Dir:        tempDir,
 		Debug:      true,
 		Actions:    []Action{ &action },
-		AfterFileAction: func(file string) {
+		AfterFileAction: func(file string, result *Result) {
 			wait <- true
 			//filename = file
 		},
@@ -177,7 +183,7 @@ func TestHandleExistingOff(t *testing.T) {
 		dontBlock: true,
 		Dir:        tempDir,
 		Debug:      true,
-		AfterFileAction: func(file string) {
+		AfterFileAction: func(file string, result *Result) {
 			expecting--
 			if expecting == 0 {
 				wait <- true
@@ -235,7 +241,7 @@ func TestHandleExistingOn(t *testing.T) {
 		dontBlock: true,
 		Dir:        tempDir,
 		Debug:      true,
-		AfterFileAction: func(file string) {
+		AfterFileAction: func(file string, result *Result) {
 			expecting--
 			if expecting == 0 {
 				wait <- true
@@ -288,7 +294,7 @@ func TestIgnoreDir(t *testing.T){
 		dontBlock: true,
 		Dir:        tempDir,
 		Debug:      true,
-		AfterFileAction: func(file string) {
+		AfterFileAction: func(file string, result *Result) {
 			expecting--
 			if expecting == 0 {
 				wait <- true
@@ -356,7 +362,7 @@ func checkParanoid( t *testing.T, paranoid ParanoiaLevel ){
 		dontBlock: true,
 		Dir:        tempDir,
 		Debug:      true,
-		AfterFileAction: func(file string) {
+		AfterFileAction: func(file string, result *Result) {
 			expecting--
 			if expecting == 0 {
 				wait <- true
@@ -428,3 +434,530 @@ func makeIs(t *testing.T) func(interface{}, interface{}, string) {
 		}
 	}
 }
+
+func TestRecursive(t *testing.T) {
+	mkTempDir := func() string {
+		s, e := ioutil.TempDir("", "springboard")
+		if e != nil {
+			panic(e)
+		}
+		return s
+	}
+
+	sep := string(os.PathSeparator)
+	tempDir := mkTempDir()
+	archDir := tempDir + sep + "arch"
+	for _, d := range []string{archDir, tempDir + sep + "acme", tempDir + sep + "acme" + sep + "deep"} {
+		if derr := os.Mkdir(d, 0777); derr != nil {
+			panic(derr)
+		}
+	}
+
+	defer func() { os.RemoveAll(tempDir) }()
+
+	wait := make(chan string)
+	cfg := Config{
+		dontBlock: true,
+		Dir:       tempDir,
+		Debug:     true,
+		AfterFileAction: func(file string, result *Result) {
+			wait <- file
+		},
+		ArchiveDir: archDir,
+		Recursive:  true,
+	}
+
+	Watch(&cfg)
+
+	tfn := tempDir + sep + "acme" + sep + "deep" + sep + "foo"
+	if _, err := os.Create(tfn); err != nil {
+		panic(err)
+	}
+
+	is := makeIs(t)
+	is(<-wait, tfn, "got the file from the existing subdirectory")
+	makeFileIn(t, "foo")(archDir+sep+"acme"+sep+"deep", true, "foo archived keeping its subdirectory")
+
+	/* now a directory created after we started */
+	if derr := os.Mkdir(tempDir+sep+"zing", 0777); derr != nil {
+		panic(derr)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	tfn = tempDir + sep + "zing" + sep + "bar"
+	if _, err := os.Create(tfn); err != nil {
+		panic(err)
+	}
+	is(<-wait, tfn, "got the file from the new subdirectory")
+	makeFileIn(t, "bar")(archDir+sep+"zing", true, "bar archived keeping its subdirectory")
+	makeFileIn(t, "bar")(tempDir+sep+"zing", false, "bar not left in the new subdirectory")
+}
+
+/* An action which records how many files it's working on at once */
+type concurrencyAction struct {
+	lock    sync.Mutex
+	running int
+	most    int
+}
+
+func (a *concurrencyAction) Process(w *Watcher, file string) bool {
+	a.lock.Lock()
+	a.running++
+	if a.running > a.most {
+		a.most = a.running
+	}
+	a.lock.Unlock()
+
+	time.Sleep(20 * time.Millisecond)
+
+	a.lock.Lock()
+	a.running--
+	a.lock.Unlock()
+	return true
+}
+
+func TestWorkers(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "springboard")
+	if err != nil {
+		panic(err)
+	}
+	defer func() { os.RemoveAll(tempDir) }()
+
+	files := 20
+	for i := 0; i < files; i++ {
+		_, err := os.Create(fmt.Sprintf("%s%sfile%d", tempDir, string(os.PathSeparator), i))
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	action := concurrencyAction{}
+	wait := make(chan bool)
+	expecting := files
+	cfg := Config{
+		dontBlock: true,
+		Dir:       tempDir,
+		Actions:   []Action{&action},
+		AfterFileAction: func(file string, result *Result) {
+			action.lock.Lock()
+			expecting--
+			done := expecting == 0
+			action.lock.Unlock()
+			if done {
+				wait <- true
+			}
+		},
+		ProcessExistingFiles: true,
+		Workers:              3,
+	}
+
+	Watch(&cfg)
+	<-wait
+
+	if action.most > 3 {
+		t.Fatal("More files processed at once than we have workers: ", action.most)
+	}
+	if action.most < 2 {
+		t.Fatal("Files weren't processed in parallel")
+	}
+}
+
+/* An action which tells us when it starts and waits to be told to finish */
+type blockingAction struct {
+	started chan string
+	release chan bool
+}
+
+func (a *blockingAction) Process(w *Watcher, file string) bool {
+	a.started <- file
+	<-a.release
+	return true
+}
+
+func TestShutdown(t *testing.T) {
+	mkTempDir := func() string {
+		s, e := ioutil.TempDir("", "springboard")
+		if e != nil {
+			panic(e)
+		}
+		return s
+	}
+
+	tempDir := mkTempDir()
+	archDir := mkTempDir()
+	defer func() { os.RemoveAll(tempDir) }()
+	defer func() { os.RemoveAll(archDir) }()
+
+	for _, v := range []string{"a", "b", "c"} {
+		_, err := os.Create(tempDir + string(os.PathSeparator) + v)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	action := blockingAction{started: make(chan string), release: make(chan bool)}
+	cfg := Config{
+		Dir:                  tempDir,
+		Actions:              []Action{&action},
+		ArchiveDir:           archDir,
+		ProcessExistingFiles: true,
+		Workers:              1,
+	}
+
+	w, err := NewWatcher(&cfg)
+	if err != nil {
+		panic(err)
+	}
+	ran := make(chan error)
+	go func() { ran <- w.Run() }()
+
+	first := <-action.started
+
+	shut := make(chan []string)
+	go func() {
+		unprocessed, err := w.Shutdown(context.Background())
+		if err != nil {
+			t.Error("Shutdown failed ", err)
+		}
+		shut <- unprocessed
+	}()
+
+	select {
+	case <-shut:
+		t.Fatal("Shutdown didn't wait for the file in progress")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	action.release <- true
+	unprocessed := <-shut
+
+	is := makeIs(t)
+	is(<-ran, nil, "Run returns once shutdown")
+	is(len(unprocessed), 2, "two files left unprocessed")
+	_, name := filepath.Split(first)
+	makeFileIn(t, name)(archDir, true, "file in progress finished and archived")
+	for _, path := range unprocessed {
+		_, name := filepath.Split(path)
+		makeFileIn(t, name)(tempDir, true, "unprocessed file left in place")
+	}
+}
+
+func TestBadAction(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "springboard")
+	if err != nil {
+		panic(err)
+	}
+	defer func() { os.RemoveAll(tempDir) }()
+
+	cfg := Config{
+		dontBlock: true,
+		Dir:       tempDir,
+		Actions:   []Action{nil},
+	}
+	if err := Watch(&cfg); err == nil {
+		t.Fatal("Watch accepted a missing action")
+	}
+}
+
+/* An action which waits until it's cancelled */
+type cancellableAction struct {
+	started chan string
+	err     chan error
+}
+
+func (a *cancellableAction) Process(ctx context.Context, w *Watcher, file string) *Result {
+	a.started <- file
+	<-ctx.Done()
+	a.err <- ctx.Err()
+	return Retryable(ctx.Err())
+}
+
+func TestShutdownCancelsActions(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "springboard")
+	if err != nil {
+		panic(err)
+	}
+	defer func() { os.RemoveAll(tempDir) }()
+
+	action := cancellableAction{started: make(chan string), err: make(chan error, 1)}
+	cfg := Config{
+		dontBlock: true,
+		Dir:       tempDir,
+		Actions:   []Action{&action},
+	}
+
+	w, err := NewWatcher(&cfg)
+	if err != nil {
+		panic(err)
+	}
+	w.Run()
+
+	if _, err := os.Create(tempDir + string(os.PathSeparator) + "foo"); err != nil {
+		panic(err)
+	}
+	<-action.started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	w.Shutdown(ctx)
+
+	select {
+	case err := <-action.err:
+		makeIs(t)(err, context.Canceled, "action saw cancellation")
+	case <-time.After(time.Second):
+		t.Fatal("Action wasn't cancelled")
+	}
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "springboard")
+	if err != nil {
+		panic(err)
+	}
+	defer func() { os.RemoveAll(tempDir) }()
+
+	action := blockingAction{started: make(chan string), release: make(chan bool)}
+	defer close(action.release)
+	cfg := Config{
+		dontBlock: true,
+		Dir:       tempDir,
+		StateDir:  filepath.Join(tempDir, ".state"),
+		Actions:   []Action{&action},
+	}
+
+	w, err := NewWatcher(&cfg)
+	if err != nil {
+		panic(err)
+	}
+	w.Run()
+
+	tfn := tempDir + string(os.PathSeparator) + "foo"
+	if _, err := os.Create(tfn); err != nil {
+		panic(err)
+	}
+	<-action.started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	unprocessed, err := w.Shutdown(ctx)
+
+	is := makeIs(t)
+	is(err, context.DeadlineExceeded, "deadline reported")
+	is(len(unprocessed), 1, "one file unprocessed")
+	is(unprocessed[0], tfn, "the file in progress is unprocessed")
+	is(w.journal.store.file == nil, true, "journal closed")
+}
+
+func TestMovedIn(t *testing.T) {
+	mkTempDir := func() string {
+		s, e := ioutil.TempDir("", "springboard")
+		if e != nil {
+			panic(e)
+		}
+		return s
+	}
+	sep := string(os.PathSeparator)
+
+	tempDir := mkTempDir()
+	archDir := mkTempDir()
+	elsewhere := mkTempDir()
+	defer os.RemoveAll(tempDir)
+	defer os.RemoveAll(archDir)
+	defer os.RemoveAll(elsewhere)
+
+	processed := make(chan string, 10)
+	cfg := Config{
+		dontBlock:  true,
+		Dir:        tempDir,
+		ArchiveDir: archDir,
+		Exclude:    []string{"*.tmp"},
+		AfterFileAction: func(file string, result *Result) {
+			_, name := filepath.Split(file)
+			processed <- name
+		},
+	}
+	w, err := NewWatcher(&cfg)
+	if err != nil {
+		panic(err)
+	}
+	if err := w.Run(); err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	/* Written under a temporary name then renamed */
+	ioutil.WriteFile(tempDir+sep+"atomic.tmp", []byte("x"), 0666)
+	os.Rename(tempDir+sep+"atomic.tmp", tempDir+sep+"atomic.xml")
+
+	/* Moved in from elsewhere */
+	ioutil.WriteFile(elsewhere+sep+"moved.xml", []byte("x"), 0666)
+	os.Rename(elsewhere+sep+"moved.xml", tempDir+sep+"moved.xml")
+
+	/* Hard linked in */
+	ioutil.WriteFile(elsewhere+sep+"linked.xml", []byte("x"), 0666)
+	if err := os.Link(elsewhere+sep+"linked.xml", tempDir+sep+"linked.xml"); err != nil {
+		t.Skip("can't hard link: ", err)
+	}
+
+	got := map[string]int{}
+	timeout := time.After(2 * time.Second)
+	for len(got) < 3 {
+		select {
+		case name := <-processed:
+			got[name]++
+		case <-timeout:
+			t.Fatal("only processed ", got)
+		}
+	}
+	select {
+	case name := <-processed:
+		t.Fatal("unexpected extra processing of ", name)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	is := makeIs(t)
+	for _, name := range []string{"atomic.xml", "moved.xml", "linked.xml"} {
+		is(got[name], 1, name+" processed once")
+		makeFileIn(t, name)(archDir, true, name+" archived")
+		is(w.wasSeen(tempDir+sep+name), false, name+" forgotten once archived")
+	}
+}
+
+func TestNoDuplicates(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "springboard")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	action := blockingAction{started: make(chan string, 10), release: make(chan bool)}
+	cfg := Config{Dir: tempDir, Actions: []Action{&action}, Workers: 2}
+	w := newWatcher(&cfg)
+	if err := w.prepare(); err != nil {
+		panic(err)
+	}
+	w.startWorkers()
+	defer w.Close()
+
+	path := tempDir + string(os.PathSeparator) + "foo"
+	ioutil.WriteFile(path, []byte("x"), 0666)
+
+	/* Say the existing file scan and a Create event both find it */
+	w.enqueue(path)
+	<-action.started
+	w.enqueue(path)
+	w.handle_event(&fsnotify.Event{Name: path, Op: fsnotify.Create})
+
+	select {
+	case <-action.started:
+		t.Fatal("processed twice at once")
+	case <-time.After(200 * time.Millisecond):
+	}
+	action.release <- true
+
+	/* Once it's done, writing to it doesn't make it new */
+	time.Sleep(50 * time.Millisecond)
+	w.handle_event(&fsnotify.Event{Name: path, Op: fsnotify.Write})
+	select {
+	case <-action.started:
+		t.Fatal("write to a file we've seen treated as new")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	/* but a write to one we've never seen does */
+	other := tempDir + string(os.PathSeparator) + "bar"
+	ioutil.WriteFile(other, []byte("x"), 0666)
+	w.handle_event(&fsnotify.Event{Name: other, Op: fsnotify.Write})
+	select {
+	case file := <-action.started:
+		makeIs(t)(file, other, "new file found by a write")
+		action.release <- true
+	case <-time.After(time.Second):
+		t.Fatal("write to a new file ignored")
+	}
+}
+
+func TestLockedByAnotherProcess(t *testing.T) {
+	mkTempDir := func() string {
+		s, e := ioutil.TempDir("", "springboard")
+		if e != nil {
+			panic(e)
+		}
+		return s
+	}
+	tempDir := mkTempDir()
+	archDir := mkTempDir()
+	defer os.RemoveAll(tempDir)
+	defer os.RemoveAll(archDir)
+
+	path := tempDir + string(os.PathSeparator) + "foo"
+	ioutil.WriteFile(path, []byte("x"), 0666)
+	lock := flock.NewFlock(path)
+	if locked, err := lock.TryLock(); !locked || err != nil {
+		t.Skip("can't lock: ", err)
+	}
+
+	results := make(chan *Result, 2)
+	cfg := Config{
+		dontBlock:            true,
+		Dir:                  tempDir,
+		ArchiveDir:           archDir,
+		ProcessExistingFiles: true,
+		AfterFileAction: func(file string, result *Result) {
+			results <- result
+		},
+	}
+	w, err := NewWatcher(&cfg)
+	if err != nil {
+		panic(err)
+	}
+	if err := w.Run(); err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	is := makeIs(t)
+	result := <-results
+	is(result.Outcome, SkipOutcome, "skipped while locked")
+	is(result.Err, errLocked, "because it's locked")
+	makeFileIn(t, "foo")(tempDir, true, "left alone")
+
+	/* Once it's been let go of and written to we have another go */
+	lock.Unlock()
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0666)
+	f.Write([]byte("y"))
+	f.Close()
+
+	select {
+	case result := <-results:
+		is(result.Outcome, SuccessOutcome, "processed once unlocked")
+		makeFileIn(t, "foo")(archDir, true, "archived")
+	case <-time.After(time.Second):
+		t.Fatal("never processed")
+	}
+}
+
+func TestEnqueueAfterShutdown(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "springboard")
+	if err != nil {
+		panic(err)
+	}
+	defer func() { os.RemoveAll(tempDir) }()
+
+	cfg := Config{dontBlock: true, Dir: tempDir, Actions: []Action{&EchoAction{}}}
+	w, err := NewWatcher(&cfg)
+	if err != nil {
+		panic(err)
+	}
+	w.Run()
+	_, err = w.Shutdown(context.Background())
+
+	is := makeIs(t)
+	is(err, nil, "shut down")
+	for i := 0; i < 100; i++ {
+		path := fmt.Sprint(tempDir, string(os.PathSeparator), i)
+		is(w.enqueue(path), false, "refused once stopping")
+	}
+	is(len(w.queue), 0, "nothing queued after the queue was drained")
+	is(len(w.dropped), 100, "every file reported as dropped")
+}